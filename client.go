@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"go/build"
@@ -9,7 +10,9 @@ import (
 	"net/rpc"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"runtime/debug"
@@ -35,7 +38,7 @@ func doClient() {
 	if flag.NArg() > 0 {
 		command = flag.Arg(0)
 		switch command {
-		case "autocomplete", "exit":
+		case "autocomplete", "exit", "status", "drop-cache":
 			// these are valid commands
 		case "close":
 			// "close" is an alias for "exit"
@@ -49,29 +52,17 @@ func doClient() {
 	// client
 	var client *rpc.Client
 	if *g_sock != "none" {
-		addr := *g_addr
-		if *g_sock == "unix" {
-			addr = getSocketPath()
-		}
-
 		var err error
-		client, err = rpc.Dial(*g_sock, addr)
+		client, err = rpc.Dial(*g_sock, serverAddr())
 		if err != nil {
-			if command == "exit" {
+			switch command {
+			case "exit", "status":
 				log.Fatal(err)
+			case "drop-cache":
+				// No daemon, so nothing is cached.
+				return
 			}
-
-			if *g_sock == "unix" {
-				_ = os.Remove(addr)
-			}
-			err = tryStartServer()
-			if err != nil {
-				log.Fatalf("Failed to start server: %s\n", err)
-			}
-			client, err = tryToConnect(*g_sock, addr)
-			if err != nil {
-				log.Fatalf("Failed to connect to %q: %s\n", addr, err)
-			}
+			client = startServer()
 		}
 		defer client.Close()
 	}
@@ -81,12 +72,59 @@ func doClient() {
 		cmdAutoComplete(client)
 	case "exit":
 		cmdExit(client)
+	case "status":
+		cmdStatus(client)
+	case "drop-cache":
+		cmdDropCache(client)
 	}
 }
 
+// serverAddr returns the address of the daemon selected by the
+// -sock and -addr flags.
+func serverAddr() string {
+	if *g_sock == "unix" {
+		return getSocketPath()
+	}
+	return *g_addr
+}
+
+// startServer starts a new daemon and connects to it.
+func startServer() *rpc.Client {
+	addr := serverAddr()
+	if *g_sock == "unix" {
+		_ = os.Remove(addr)
+	}
+	if err := tryStartServer(); err != nil {
+		log.Fatalf("Failed to start server: %s\n", err)
+	}
+	client, err := tryToConnect(*g_sock, addr)
+	if err != nil {
+		log.Fatalf("Failed to connect to %q: %s\n", addr, err)
+	}
+	return client
+}
+
 func tryStartServer() error {
 	path := get_executable_filename()
-	args := []string{os.Args[0], "-s", "-sock", *g_sock, "-addr", *g_addr}
+	idle := defaultIdleTimeout
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "idle" {
+			idle = *g_idle
+		}
+	})
+	args := []string{os.Args[0], "-s", "-sock", *g_sock, "-addr", *g_addr, "-idle", idle.String()}
+	if *g_log != "" {
+		// The daemon's working directory may differ from ours.
+		logfile, err := filepath.Abs(*g_log)
+		if err != nil {
+			return err
+		}
+		args = append(args, "-log", logfile, "-log-format", *g_log_format)
+		// Debug output is only worth producing if it's kept.
+		if *g_debug {
+			args = append(args, "-debug")
+		}
+	}
 	cwd, _ := os.Getwd()
 
 	var err error
@@ -123,20 +161,63 @@ func tryToConnect(network, address string) (*rpc.Client, error) {
 	}
 }
 
+// stopServer asks the daemon behind c to exit and waits until it
+// stops accepting connections.
+func stopServer(c *rpc.Client, network, address string) error {
+	cmdExit(c)
+	c.Close()
+
+	start := time.Now()
+	for time.Since(start) < 5*time.Second {
+		client, err := rpc.Dial(network, address)
+		if err != nil {
+			return nil
+		}
+		client.Close()
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fmt.Errorf("server at %q is still running", address)
+}
+
 func cmdAutoComplete(c *rpc.Client) {
 	var req AutoCompleteRequest
 	req.Filename, req.Data, req.Cursor = prepareFilenameDataCursor()
-	req.Context = gbimporter.PackContext(&build.Default)
-	req.Source = *g_source
+	req.Context = gbimporter.PackContext(clientBuildContext())
+	req.Mode = importerMode()
 	req.Builtin = *g_builtin
+	req.Fuzzy = *g_fuzzy
+	req.Edits = suggest.EditFormats[*g_format]
+	req.Timeout = *g_timeout
+	req.BuildID, req.GoVersion = buildID(), runtime.Version()
+	if *g_overlay != "" {
+		overlay, err := readOverlay(*g_overlay)
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Overlay = overlay
+	}
 
 	var res AutoCompleteReply
 	var err error
 	if c == nil {
-		s := Server{}
-		err = s.AutoComplete(&req, &res)
+		err = newServer().AutoComplete(&req, &res)
 	} else {
 		err = c.Call("Server.AutoComplete", &req, &res)
+		if err == nil && !sameBuild(res.BuildID, res.GoVersion) {
+			// The daemon was built from a different gocode or
+			// Go release, so replace it with one of our own
+			// and ask again.
+			if *g_debug {
+				log.Printf("Restarting stale gocode daemon\n")
+			}
+			if err := stopServer(c, *g_sock, serverAddr()); err != nil {
+				log.Fatalf("Failed to stop stale server: %s\n", err)
+			}
+			c = startServer()
+			defer c.Close()
+			res = AutoCompleteReply{}
+			err = c.Call("Server.AutoComplete", &req, &res)
+		}
 	}
 	if err != nil {
 		log.Fatal(err)
@@ -146,7 +227,109 @@ func cmdAutoComplete(c *rpc.Client) {
 	if fmt == nil {
 		fmt = suggest.NiceFormat
 	}
-	fmt(os.Stdout, res.Candidates, res.Len)
+	fmt(os.Stdout, res.Candidates, res.Len, res.Error, res.Partial)
+}
+
+// importerMode returns the importer mode selected by the -importer
+// and -source flags.
+func importerMode() gbimporter.Mode {
+	if *g_source {
+		return gbimporter.SourceMode
+	}
+	switch *g_importer {
+	case "gc":
+	case "source":
+		return gbimporter.SourceMode
+	case "auto":
+		return gbimporter.AutoMode
+	case "golist":
+		return gbimporter.GoListMode
+	default:
+		log.Fatalf("unknown importer %q", *g_importer)
+	}
+	return gbimporter.GCMode
+}
+
+// readOverlay reads an overlay file in the format of go build's
+// -overlay flag and returns the contents of the replaced files, keyed
+// by absolute filename.
+func readOverlay(name string) (map[string][]byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var overlay struct {
+		Replace map[string]string
+	}
+	if err := json.Unmarshal(data, &overlay); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	res := make(map[string][]byte)
+	for from, to := range overlay.Replace {
+		if to == "" {
+			// Deleting files isn't supported.
+			continue
+		}
+		src, err := ioutil.ReadFile(to)
+		if err != nil {
+			return nil, err
+		}
+		from, err = filepath.Abs(from)
+		if err != nil {
+			return nil, err
+		}
+		res[from] = src
+	}
+	return res, nil
+}
+
+// clientBuildContext returns build.Default adjusted by the -tags,
+// -goos and -goarch flags.
+func clientBuildContext() *build.Context {
+	bctx := build.Default
+
+	tags, ok := "", false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "tags" {
+			tags, ok = *g_tags, true
+		}
+	})
+	if !ok {
+		tags, ok = goflagsTags()
+	}
+	if ok {
+		// Like the go command, accept the old space-separated
+		// form too.
+		bctx.BuildTags = strings.FieldsFunc(tags, func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+	}
+
+	if *g_goos != "" {
+		bctx.GOOS = *g_goos
+	}
+	if *g_goarch != "" {
+		bctx.GOARCH = *g_goarch
+	}
+	if (bctx.GOOS != runtime.GOOS || bctx.GOARCH != runtime.GOARCH) && os.Getenv("CGO_ENABLED") == "" {
+		// The go command disables cgo when cross-compiling.
+		bctx.CgoEnabled = false
+	}
+	return &bctx
+}
+
+// goflagsTags returns the value of the -tags flag in $GOFLAGS, if it
+// has one.
+func goflagsTags() (string, bool) {
+	tags, ok := "", false
+	for _, f := range strings.Fields(os.Getenv("GOFLAGS")) {
+		f = strings.TrimPrefix(strings.TrimPrefix(f, "-"), "-")
+		if strings.HasPrefix(f, "tags=") {
+			tags, ok = strings.TrimPrefix(f, "tags="), true
+		}
+	}
+	return tags, ok
 }
 
 func cmdExit(c *rpc.Client) {
@@ -160,6 +343,42 @@ func cmdExit(c *rpc.Client) {
 	}
 }
 
+func cmdStatus(c *rpc.Client) {
+	if c == nil {
+		// A server started just for this would report nothing
+		// of interest.
+		log.Fatal("status requires a daemon, but -sock is none")
+	}
+	var req StatusRequest
+	var res StatusReply
+	if err := c.Call("Server.Status", &req, &res); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt := statusFormatters[*g_format]
+	if fmt == nil {
+		fmt = niceStatusFormat
+	}
+	fmt(os.Stdout, &res)
+}
+
+func cmdDropCache(c *rpc.Client) {
+	if c == nil {
+		return
+	}
+	var req DropCacheRequest
+	var res DropCacheReply
+	req.Paths = flag.Args()[1:]
+	req.Context = gbimporter.PackContext(clientBuildContext())
+	req.Dir, _ = os.Getwd()
+	if err := c.Call("Server.DropCache", &req, &res); err != nil {
+		log.Fatal(err)
+	}
+	if *g_debug {
+		log.Printf("Dropped %d packages and %d files\n", res.Packages, res.Files)
+	}
+}
+
 func prepareFilenameDataCursor() (string, []byte, int) {
 	var file []byte
 	var err error
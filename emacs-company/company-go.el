@@ -106,10 +106,15 @@ symbol is preceded by a \".\", ignoring `company-minimum-prefix-length'."
           strings))
 
 (defun company-go--candidates ()
-  (let ((candidates (company-go--get-candidates (split-string (company-go--invoke-autocomplete) "\n" t))))
-    (if (equal candidates '("PANIC"))
-        (error "GOCODE PANIC: Please check your code by \"go build\"")
-      candidates)))
+  (let ((lines (split-string (company-go--invoke-autocomplete) "\n" t)))
+    (when (and lines (string-prefix-p "error,," (car lines)))
+      (let ((err (split-string (car lines) ",,")))
+        (message "gocode: %s error: %s" (nth 1 err) (nth 2 err)))
+      (setq lines (cdr lines)))
+    (when (and lines (string-prefix-p "partial,," (car lines)))
+      (message "gocode: timed out, completions may be incomplete")
+      (setq lines (cdr lines)))
+    (company-go--get-candidates lines)))
 
 (defun company-go--location (arg)
   (when (require 'go-mode nil t)
@@ -180,11 +180,15 @@
 (defun ac-go-candidates ()
   (let ((candidates (ac-go-get-candidates
                      (ac-go-format-autocomplete (ac-go-invoke-autocomplete)))))
-    (if (equal candidates '("PANIC"))
-        (progn
-          (message "GOCODE PANIC: Please check your code by \"go build\"")
-          nil)
-      candidates)))
+    (let ((err (car (member "gocode-error" candidates)))
+          (partial (car (member "gocode-partial" candidates))))
+      (cond
+       (err
+        (message "gocode: %s" (get-text-property 0 'summary err)))
+       (partial
+        (message "gocode: %s, completions may be incomplete"
+                 (get-text-property 0 'summary partial))))
+      (remove partial (remove err candidates)))))
 
 (defun ac-go-prefix ()
   (or (ac-prefix-symbol)
@@ -5,19 +5,34 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 var (
-	g_is_server = flag.Bool("s", false, "run a server instead of a client")
-	g_format    = flag.String("f", "nice", "output format (vim | emacs | nice | csv | json)")
-	g_input     = flag.String("in", "", "use this file instead of stdin input")
-	g_sock      = flag.String("sock", defaultSocketType, "socket type (unix | tcp | none)")
-	g_addr      = flag.String("addr", "127.0.0.1:37373", "address for tcp socket")
-	g_debug     = flag.Bool("debug", false, "enable server-side debug mode")
-	g_source    = flag.Bool("source", false, "use source importer")
-	g_builtin   = flag.Bool("builtin", false, "propose builtin objects")
+	g_is_server  = flag.Bool("s", false, "run a server instead of a client")
+	g_format     = flag.String("f", "nice", "output format (vim | emacs | nice | csv | json)")
+	g_input      = flag.String("in", "", "use this file instead of stdin input")
+	g_sock       = flag.String("sock", defaultSocketType, "socket type (unix | tcp | none)")
+	g_addr       = flag.String("addr", "127.0.0.1:37373", "address for tcp socket")
+	g_debug      = flag.Bool("debug", false, "enable server-side debug mode")
+	g_source     = flag.Bool("source", false, "use source importer (same as -importer=source)")
+	g_importer   = flag.String("importer", "gc", "importer (gc | source | auto | golist)")
+	g_builtin    = flag.Bool("builtin", false, "propose builtin objects")
+	g_fuzzy      = flag.Bool("fuzzy", false, "match candidates fuzzily instead of by prefix")
+	g_idle       = flag.Duration("idle", 0, "shut the server down after being idle this long (0 = never)")
+	g_timeout    = flag.Duration("timeout", 0, "stop importing packages after this long and return partial results (0 = no limit)")
+	g_log        = flag.String("log", "", "write server logs to this file instead of stderr")
+	g_log_format = flag.String("log-format", "text", "server log format (text | json)")
+	g_overlay    = flag.String("overlay", "", "JSON file replacing the contents of unsaved files, as with 'go build -overlay'")
+	g_tags       = flag.String("tags", "", "comma-separated list of build tags (default from -tags in $GOFLAGS)")
+	g_goos       = flag.String("goos", "", "target operating system (default $GOOS)")
+	g_goarch     = flag.String("goarch", "", "target architecture (default $GOARCH)")
 )
 
+// defaultIdleTimeout is the idle timeout passed to daemons started
+// automatically by the client, unless -idle is given explicitly.
+const defaultIdleTimeout = 30 * time.Minute
+
 func getSocketPath() string {
 	user := os.Getenv("USER")
 	if user == "" {
@@ -37,7 +52,10 @@ func usage() {
 	fmt.Fprintf(os.Stderr,
 		"\nCommands:\n"+
 			"  autocomplete [<path>] <offset>     main autocompletion command\n"+
-			"  exit                               terminate the gocode daemon\n")
+			"  drop-cache [<importpath>...]       discard cached data, optionally only for the given\n"+
+			"                                     packages and the packages that depend on them\n"+
+			"  exit                               terminate the gocode daemon\n"+
+			"  status                             show information about the gocode daemon\n")
 }
 
 func main() {
@@ -0,0 +1,714 @@
+package gbimporter
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	goimporter "go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Cache holds packages imported by earlier requests so that a
+// long-running daemon doesn't have to reload export data or
+// re-typecheck sources on every completion request.
+//
+// Packages are partitioned by build context, importer flavor and gb
+// project root, and are invalidated when the export data or the
+// source files they were loaded from change, on disk or in the
+// importer's overlay.
+type Cache struct {
+	mu    sync.Mutex
+	parts map[string]*partition
+
+	// mods holds the main modules and workspaces seen so far,
+	// keyed by go.mod or go.work file and module cache.
+	mods map[string]*module
+}
+
+func NewCache() *Cache {
+	return &Cache{
+		parts: make(map[string]*partition),
+		mods:  make(map[string]*module),
+	}
+}
+
+// A Mode selects where an Importer loads packages from.
+type Mode int
+
+const (
+	// GCMode loads packages from their export data.
+	GCMode Mode = iota
+
+	// SourceMode type-checks packages from source.
+	SourceMode
+
+	// AutoMode loads packages from their export data when it's
+	// up to date, and from source when it's stale, missing or
+	// unreadable.
+	AutoMode
+
+	// GoListMode loads packages from export data in the go
+	// command's build cache, as located (and built if needed) by
+	// go list -export, and from source when that fails.
+	GoListMode
+)
+
+// Importer returns an importer for filename that resolves imports
+// using ctx and shares previously imported packages with other
+// importers created by c for the same configuration.
+func (c *Cache) Importer(ctx *PackedContext, filename string, mode Mode) *Importer {
+	mod, bctx, root := c.resolver(ctx, filename)
+	key := contextKey(ctx, root, mode)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.parts[key]
+	if p == nil {
+		p = &partition{
+			mu:      newSemaphore(),
+			root:    root,
+			mode:    mode,
+			fset:    token.NewFileSet(),
+			pkgs:    make(map[string]*cacheEntry),
+			loading: make(map[string]bool),
+		}
+		c.parts[key] = p
+	}
+
+	return &Importer{
+		ctx:     ctx,
+		bctx:    bctx,
+		mod:     mod,
+		part:    p,
+		checked: make(map[string]bool),
+	}
+}
+
+// resolver returns the main module and build context for resolving
+// imports from filename under ctx, and the root of its gb project,
+// main module or workspace, if any.
+func (c *Cache) resolver(ctx *PackedContext, filename string) (*module, *build.Context, string) {
+	if mod := c.module(ctx, filename); mod != nil {
+		return mod, ctx.BuildContext(), mod.file
+	}
+	bctx, root := buildContext(ctx, filename)
+	return nil, bctx, root
+}
+
+// PackageDir returns the source directory of the package with the
+// given import path, as imported from filename under ctx.
+func (c *Cache) PackageDir(ctx *PackedContext, filename, path string) (string, error) {
+	mod, bctx, _ := c.resolver(ctx, filename)
+
+	i := &Importer{ctx: ctx, bctx: bctx, mod: mod}
+	bp, err := i.findPackage(path, filepath.Dir(filename))
+	if err != nil {
+		return "", err
+	}
+	return bp.Dir, nil
+}
+
+// module returns the main module or workspace that filename belongs
+// to, or nil if filename isn't in a module.
+func (c *Cache) module(ctx *PackedContext, filename string) *module {
+	if ctx.GO111MODULE == "off" || filename == "" {
+		return nil
+	}
+	dir := filepath.Dir(filename)
+	gomod := findFile(dir, "go.mod")
+	if gomod == "" || hasFilePathPrefix(gomod, ctx.GOROOT) {
+		// The standard library is a module too, but it's
+		// always resolved through GOROOT.
+		return nil
+	}
+
+	gowork := ctx.GOWORK
+	switch gowork {
+	case "off":
+		gowork = ""
+	case "":
+		gowork = findFile(dir, "go.work")
+	}
+	if gowork != "" {
+		m := c.loadModule(ctx, gowork, loadWorkspace)
+		if m != nil && m.contains(filepath.Dir(gomod)) {
+			return m
+		}
+		// Like the go command, ignore workspaces that
+		// don't use filename's module.
+	}
+	return c.loadModule(ctx, gomod, loadModule)
+}
+
+// loadModule returns the main module or workspace described by file,
+// calling load to (re)load it if it isn't cached or has changed. The
+// files are read without holding c.mu, so a slow file system doesn't
+// hold up requests for other configurations.
+func (c *Cache) loadModule(ctx *PackedContext, file string, load func(*PackedContext, string) (*module, error)) *module {
+	key := file + "\x00" + modCacheDir(ctx)
+	c.mu.Lock()
+	old := c.mods[key]
+	c.mu.Unlock()
+	if old != nil && !old.stale() {
+		return old
+	}
+
+	m, err := load(ctx, file)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cur := c.mods[key]; cur != nil && cur != old {
+		// Another request reloaded it meanwhile.
+		return cur
+	}
+	if old != nil {
+		// The requirements may have changed, so forget the
+		// packages imported through the old ones.
+		for key, p := range c.parts {
+			if p.root == old.file {
+				delete(c.parts, key)
+			}
+		}
+	}
+	if err != nil {
+		delete(c.mods, key)
+		return nil
+	}
+	c.mods[key] = m
+	return m
+}
+
+// Len returns the number of packages currently held by c.
+func (c *Cache) Len() int {
+	n := 0
+	for _, p := range c.partitions() {
+		p.mu.Lock()
+		n += len(p.pkgs)
+		p.mu.Unlock()
+	}
+	return n
+}
+
+// partitions returns the partitions currently in c. Callers lock
+// each one without holding c.mu, so that imports in progress don't
+// hold up unrelated partitions.
+func (c *Cache) partitions() []*partition {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	parts := make([]*partition, 0, len(c.parts))
+	for _, p := range c.parts {
+		parts = append(parts, p)
+	}
+	return parts
+}
+
+// Drop removes the packages with the given import paths from c,
+// along with any cached packages that depend on them, and returns
+// the source directories of the removed packages. If paths is empty,
+// Drop empties c entirely. Either way, the packages available for
+// import are looked up afresh next time.
+func (c *Cache) Drop(paths []string) []string {
+	var parts []*partition
+	if len(paths) == 0 {
+		c.mu.Lock()
+		for _, p := range c.parts {
+			parts = append(parts, p)
+		}
+		c.parts = make(map[string]*partition)
+		c.mods = make(map[string]*module)
+		c.mu.Unlock()
+	} else {
+		parts = c.partitions()
+	}
+
+	var dirs []string
+	for _, p := range parts {
+		p.mu.Lock()
+		if len(paths) == 0 {
+			for _, e := range p.pkgs {
+				dirs = append(dirs, e.dir)
+			}
+		} else {
+			dirs = append(dirs, p.drop(paths)...)
+		}
+		p.mu.Unlock()
+
+		p.indexMu.Lock()
+		p.index = nil
+		p.indexMu.Unlock()
+	}
+	return dirs
+}
+
+// contextKey returns a string uniquely identifying the import
+// configuration described by its arguments. root identifies the gb
+// project, main module or workspace, if any.
+func contextKey(ctx *PackedContext, root string, mode Mode) string {
+	return strings.Join([]string{
+		ctx.GOROOT,
+		ctx.GOPATH,
+		ctx.GOOS,
+		ctx.GOARCH,
+		ctx.Compiler,
+		ctx.InstallSuffix,
+		tagsKey(ctx.BuildTags),
+		strings.Join(ctx.ReleaseTags, ","),
+		boolKey(ctx.CgoEnabled),
+		boolKey(ctx.UseAllFiles),
+		ctx.GO111MODULE,
+		ctx.GOMODCACHE,
+		ctx.GOWORK,
+		root,
+		strconv.Itoa(int(mode)),
+	}, "\x00")
+}
+
+// tagsKey returns a key for a set of build tags, regardless of their
+// order.
+func tagsKey(tags []string) string {
+	sorted := append([]string(nil), tags...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+func boolKey(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// partition is the set of packages cached for a single import
+// configuration. Its mutex is held for the duration of each
+// top-level import, so requests for different configurations never
+// wait on each other.
+type partition struct {
+	mu   semaphore
+	root string // as passed to contextKey
+	mode Mode
+	fset *token.FileSet
+	pkgs map[string]*cacheEntry
+
+	// loading tracks the packages being type-checked from
+	// source, to detect import cycles.
+	loading map[string]bool
+
+	// gc reads export data for packages in exports. It keeps its
+	// own map of loaded packages, so it's replaced whenever a
+	// cached package goes stale to make sure it actually rereads
+	// the export data. The packages it loaded before are evicted
+	// along with it, since they refer to types that the new one
+	// would load again as distinct objects.
+	gc      types.ImporterFrom
+	exports map[string]string
+
+	// listed holds the export data files reported by go list
+	// -deps in GoListMode, so that dependencies don't need a go
+	// list of their own. It's reset whenever a cached package
+	// goes stale, since the export data of packages depending on
+	// it may have changed too.
+	listed map[string]string
+
+	// index caches the packages that can be imported. It's
+	// guarded by indexMu rather than mu, so that looking up
+	// packages doesn't wait for imports in progress.
+	indexMu sync.Mutex
+	index   *packageIndex
+}
+
+type cacheEntry struct {
+	pkg *types.Package
+	dir string
+
+	// deps are the cached packages that pkg was type-checked
+	// against or, for export data, the cached packages it refers
+	// to.
+	deps []*types.Package
+
+	// files are the source files parsed into the partition's
+	// FileSet, so they can be released when pkg is evicted.
+	files []*token.File
+
+	// dirStamp and objStamp are the modification times observed
+	// for the source directory and export data file that pkg was
+	// loaded from.
+	dirStamp time.Time
+	obj      string
+	objStamp time.Time
+
+	// overlay identifies the overlaid contents of the source
+	// files pkg was loaded from, if any.
+	overlay string
+}
+
+// A semaphore is a mutex whose callers can give up waiting for it.
+type semaphore chan struct{}
+
+func newSemaphore() semaphore {
+	return make(semaphore, 1)
+}
+
+func (s semaphore) Lock() {
+	s <- struct{}{}
+}
+
+func (s semaphore) Unlock() {
+	<-s
+}
+
+// lockBefore locks s unless deadline, if non-zero, passes first, and
+// reports whether it did.
+func (s semaphore) lockBefore(deadline time.Time) bool {
+	if deadline.IsZero() {
+		s.Lock()
+		return true
+	}
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	select {
+	case s <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// importPackage returns the package described by bp, loading it if
+// it isn't cached or has gone stale. p.mu must be held.
+func (p *partition) importPackage(i *Importer, bp *build.Package) (*types.Package, error) {
+	if e := p.pkgs[bp.ImportPath]; e != nil {
+		if i.valid(e) {
+			return e.pkg, nil
+		}
+		p.evict(bp.ImportPath)
+	}
+
+	if p.loading[bp.ImportPath] {
+		return nil, fmt.Errorf("import cycle through %q", bp.ImportPath)
+	}
+	p.loading[bp.ImportPath] = true
+	defer delete(p.loading, bp.ImportPath)
+
+	expired := i.expired
+	e := &cacheEntry{
+		dir:      bp.Dir,
+		dirStamp: dirStamp(bp.Dir),
+		overlay:  i.overlayKey(bp.Dir),
+	}
+	var err error
+	switch {
+	case p.mode == SourceMode || e.overlay != "":
+		// There's no export data for unsaved files.
+		err = p.loadSource(i, bp, e)
+	case p.mode == GoListMode:
+		err = p.loadGoList(i, bp, e)
+		if err != nil && err != ErrDeadline {
+			e.pkg, e.obj, e.objStamp = nil, "", time.Time{}
+			err = p.loadSource(i, bp, e)
+		}
+	case i.mod != nil && !bp.Goroot:
+		// There's no export data for module packages outside
+		// of the go command's build cache.
+		err = p.loadSource(i, bp, e)
+	case p.mode == AutoMode:
+		// Export data from the go command's build cache is
+		// always up to date, but installed packages go stale
+		// as soon as their sources change.
+		err = p.loadExport(i, bp, e)
+		if err == nil && e.obj == bp.PkgObj && e.objStamp.Before(e.dirStamp) {
+			err = fmt.Errorf("export data for %q is older than its sources", bp.ImportPath)
+		}
+		if err != nil && err != ErrDeadline {
+			// That includes export data written by an
+			// incompatible toolchain, which the gc
+			// importer refuses to read.
+			e.pkg, e.obj, e.objStamp = nil, "", time.Time{}
+			err = p.loadSource(i, bp, e)
+		}
+	default:
+		err = p.loadExport(i, bp, e)
+	}
+	if err == ErrDeadline {
+		i.expired = true
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't cache packages that are missing dependencies only
+	// because this request ran out of time.
+	if i.expired && !expired {
+		return e.pkg, nil
+	}
+	p.pkgs[bp.ImportPath] = e
+	i.checked[bp.ImportPath] = true
+	return e.pkg, nil
+}
+
+// valid reports whether neither e's files nor any of the packages it
+// was checked against have changed since e was loaded.
+func (i *Importer) valid(e *cacheEntry) bool {
+	path := e.pkg.Path()
+	if ok, seen := i.checked[path]; seen {
+		return ok
+	}
+
+	// Assume e is valid while checking its dependencies, in
+	// case they refer back to it.
+	i.checked[path] = true
+	ok := e.fresh() && e.overlay == i.overlayKey(e.dir)
+	for _, dep := range e.deps {
+		if !ok {
+			break
+		}
+		de := i.part.pkgs[dep.Path()]
+		ok = de != nil && de.pkg == dep && i.valid(de)
+	}
+	i.checked[path] = ok
+	return ok
+}
+
+// evict removes path from p, along with every package loaded from
+// export data if path was one, since they share p.gc. p.mu must be
+// held.
+func (p *partition) evict(path string) {
+	e := p.pkgs[path]
+	if e == nil {
+		return
+	}
+	for _, f := range e.files {
+		p.fset.RemoveFile(f)
+	}
+	delete(p.pkgs, path)
+	p.listed = nil
+	if e.obj != "" {
+		p.gc = nil
+		for path, e := range p.pkgs {
+			if e.obj != "" {
+				delete(p.pkgs, path)
+			}
+		}
+	}
+}
+
+// drop removes the packages matching paths and their reverse
+// dependencies from p, returning their source directories. p.mu
+// must be held.
+func (p *partition) drop(paths []string) []string {
+	matches := func(pkg *types.Package) bool {
+		for _, path := range paths {
+			if pkg.Path() == path || strings.HasSuffix(pkg.Path(), "/vendor/"+path) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var dirs []string
+	for path, e := range p.pkgs {
+		if matches(e.pkg) || dependsOn(e.pkg, matches) {
+			dirs = append(dirs, e.dir)
+			p.evict(path)
+		}
+	}
+	return dirs
+}
+
+// dependsOn reports whether pkg transitively imports a package for
+// which match returns true.
+func dependsOn(pkg *types.Package, match func(*types.Package) bool) bool {
+	seen := make(map[*types.Package]bool)
+	var walk func(pkg *types.Package) bool
+	walk = func(pkg *types.Package) bool {
+		for _, dep := range pkg.Imports() {
+			if seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			if match(dep) || walk(dep) {
+				return true
+			}
+		}
+		return false
+	}
+	return walk(pkg)
+}
+
+// loadExport loads bp from its export data into e.
+func (p *partition) loadExport(i *Importer, bp *build.Package, e *cacheEntry) error {
+	obj, err := exportFile(i.ctx, bp, i.deadline)
+	if err != nil {
+		return err
+	}
+	return p.readExport(bp, e, obj)
+}
+
+// loadGoList loads bp into e from the export data that go list
+// reports for it.
+func (p *partition) loadGoList(i *Importer, bp *build.Package, e *cacheEntry) error {
+	obj, ok := p.listed[bp.ImportPath]
+	if !ok {
+		// The go command needs to run in the main module to
+		// resolve its dependencies.
+		dir := bp.Dir
+		if i.mod != nil {
+			dir = i.mod.dir
+		}
+		listed, err := goListExports(i.ctx, dir, bp.ImportPath, true, i.deadline)
+		if err == ErrDeadline {
+			// Running out of time says nothing about the
+			// package, so try again next time.
+			return err
+		}
+		if p.listed == nil {
+			p.listed = make(map[string]string)
+		}
+		if err != nil {
+			// Don't keep running the go command for
+			// packages it can't handle.
+			p.listed[bp.ImportPath] = ""
+			return err
+		}
+		for path, obj := range listed {
+			p.listed[path] = obj
+		}
+		obj = listed[bp.ImportPath]
+	}
+	if obj == "" {
+		return fmt.Errorf("can't find export data for %q", bp.ImportPath)
+	}
+	return p.readExport(bp, e, obj)
+}
+
+// readExport loads bp from the export data in obj into e.
+func (p *partition) readExport(bp *build.Package, e *cacheEntry, obj string) error {
+	if p.gc == nil {
+		p.exports = make(map[string]string)
+		p.gc = goimporter.ForCompiler(p.fset, "gc", p.openExport).(types.ImporterFrom)
+	}
+	p.exports[bp.ImportPath] = obj
+
+	pkg, err := p.gc.ImportFrom(bp.ImportPath, bp.Dir, 0)
+	if err != nil {
+		return err
+	}
+	e.pkg = pkg
+	e.deps = p.cachedDeps(pkg)
+	e.obj = obj
+	e.objStamp = fileStamp(obj)
+	return nil
+}
+
+func (p *partition) openExport(path string) (io.ReadCloser, error) {
+	obj, ok := p.exports[path]
+	if !ok {
+		return nil, fmt.Errorf("can't find export data for %q", path)
+	}
+	return os.Open(obj)
+}
+
+// exportFile returns the name of the file holding bp's export data.
+// If the go command has to find it, it's given until deadline.
+func exportFile(ctx *PackedContext, bp *build.Package, deadline time.Time) (string, error) {
+	if bp.PkgObj != "" {
+		if _, err := os.Stat(bp.PkgObj); err == nil {
+			return bp.PkgObj, nil
+		}
+	}
+	if bp.Goroot {
+		// Since Go 1.20, GOROOT no longer ships with
+		// compiled packages.
+		return goListExport(ctx, bp.ImportPath, deadline)
+	}
+	return "", fmt.Errorf("can't find export data for %q", bp.ImportPath)
+}
+
+// loadSource type-checks bp from source into e. Its dependencies are
+// imported through i, so they're cached too.
+func (p *partition) loadSource(i *Importer, bp *build.Package, e *cacheEntry) error {
+	full, err := i.bctx.ImportDir(bp.Dir, 0)
+	if err != nil {
+		return err
+	}
+
+	var files []*ast.File
+	for _, name := range append(full.GoFiles, full.CgoFiles...) {
+		file, err := parser.ParseFile(p.fset, filepath.Join(full.Dir, name), i.source(filepath.Join(full.Dir, name)), 0)
+		if file == nil {
+			return err
+		}
+		files = append(files, file)
+		e.files = append(e.files, p.fset.File(file.FileStart))
+	}
+
+	cfg := types.Config{
+		Importer:         i,
+		FakeImportC:      true,
+		IgnoreFuncBodies: true,
+		Error:            func(err error) {},
+	}
+	e.pkg, _ = cfg.Check(bp.ImportPath, p.fset, files, nil)
+	e.deps = p.cachedDeps(e.pkg)
+	return nil
+}
+
+// cachedDeps returns the packages imported by pkg that are cached in
+// p as they were imported.
+func (p *partition) cachedDeps(pkg *types.Package) []*types.Package {
+	var deps []*types.Package
+	for _, dep := range pkg.Imports() {
+		// Skip unsafe, C and anything we failed to cache.
+		if de := p.pkgs[dep.Path()]; de != nil && de.pkg == dep {
+			deps = append(deps, dep)
+		}
+	}
+	return deps
+}
+
+// fresh reports whether none of the files e was loaded from have
+// changed since.
+func (e *cacheEntry) fresh() bool {
+	if !dirStamp(e.dir).Equal(e.dirStamp) {
+		return false
+	}
+	return e.obj == "" || fileStamp(e.obj).Equal(e.objStamp)
+}
+
+// dirStamp returns the newest modification time of dir and the Go
+// source files within it. Including dir itself catches files being
+// added, removed or renamed.
+func dirStamp(dir string) time.Time {
+	stamp := fileStamp(dir)
+	dents, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return stamp
+	}
+	for _, dent := range dents {
+		if !strings.HasSuffix(dent.Name(), ".go") {
+			continue
+		}
+		if t := dent.ModTime(); t.After(stamp) {
+			stamp = t
+		}
+	}
+	return stamp
+}
+
+func fileStamp(name string) time.Time {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
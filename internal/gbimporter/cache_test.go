@@ -0,0 +1,294 @@
+package gbimporter
+
+import (
+	"go/build"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestContextKey(t *testing.T) {
+	key := func(goos string, tags ...string) string {
+		ctx := PackContext(&build.Default)
+		ctx.GOOS = goos
+		ctx.BuildTags = tags
+		return contextKey(&ctx, "", GCMode)
+	}
+
+	if key("linux", "a", "b") != key("linux", "b", "a") {
+		t.Errorf("build tag order changes the partition")
+	}
+	for _, other := range []string{key("linux", "a"), key("linux"), key("windows", "a", "b")} {
+		if other == key("linux", "a", "b") {
+			t.Errorf("different configurations share a partition")
+		}
+	}
+}
+
+// writeFiles writes files, keyed by slash-separated names relative
+// to dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, src := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// importAll imports paths through a new importer from cache for the
+// package in srcDir.
+func importAll(t *testing.T, cache *Cache, ctx *PackedContext, srcDir string, mode Mode, paths ...string) map[string]*types.Package {
+	t.Helper()
+	imp := cache.Importer(ctx, filepath.Join(srcDir, "x.go"), mode)
+	pkgs := make(map[string]*types.Package)
+	for _, path := range paths {
+		pkg, err := imp.ImportFrom(path, srcDir, 0)
+		if err != nil {
+			t.Fatalf("import %s: %v", path, err)
+		}
+		pkgs[path] = pkg
+	}
+	return pkgs
+}
+
+// checkReloaded reports an error for each package in after that was
+// reloaded since before, or wasn't, unless it's listed in reloaded.
+func checkReloaded(t *testing.T, before, after map[string]*types.Package, reloaded ...string) {
+	t.Helper()
+	want := make(map[string]bool)
+	for _, path := range reloaded {
+		want[path] = true
+	}
+	for path, pkg := range after {
+		if got := pkg != before[path]; got != want[path] {
+			t.Errorf("%s reloaded = %v, want %v", path, got, want[path])
+		}
+	}
+}
+
+func TestInvalidation(t *testing.T) {
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = t.TempDir()
+	ctx.GO111MODULE = "off"
+
+	src := filepath.Join(ctx.GOPATH, "src")
+	writeFiles(t, src, map[string]string{
+		"example.com/a/a.go": "package a\n\ntype T int\n",
+		"example.com/b/b.go": "package b\n\nimport \"example.com/a\"\n\nvar X a.T\n",
+		"example.com/c/c.go": "package c\n\nfunc C() {}\n",
+	})
+	srcDir := filepath.Join(src, "example.com", "p")
+	paths := []string{"example.com/a", "example.com/b", "example.com/c"}
+
+	cache := NewCache()
+	before := importAll(t, cache, &ctx, srcDir, SourceMode, paths...)
+	checkReloaded(t, before, importAll(t, cache, &ctx, srcDir, SourceMode, paths...))
+
+	// Editing a reloads it and b, which depends on it, but not c.
+	writeFiles(t, src, map[string]string{
+		"example.com/a/a.go": "package a\n\ntype T string\n",
+	})
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(src, "example.com", "a", "a.go"), future, future)
+	after := importAll(t, cache, &ctx, srcDir, SourceMode, paths...)
+	checkReloaded(t, before, after, "example.com/a", "example.com/b")
+	if got := after["example.com/b"].Scope().Lookup("X").Type(); got != after["example.com/a"].Scope().Lookup("T").Type() {
+		t.Errorf("b.X has type %v from a stale copy of a", got)
+	}
+}
+
+func TestExportInvalidation(t *testing.T) {
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = t.TempDir()
+	ctx.GO111MODULE = "off"
+
+	src := filepath.Join(ctx.GOPATH, "src")
+	pkgDir := filepath.Join(ctx.GOPATH, "pkg", ctx.GOOS+"_"+ctx.GOARCH)
+	writeFiles(t, src, map[string]string{
+		"example.com/v/v.go": "package v\n\nfunc New() error { return nil }\n",
+		"example.com/w/w.go": "package w\n\nfunc W() {}\n",
+		"example.com/d/d.go": "package d\n\nimport \"example.com/v\"\n\nvar E = v.New()\n",
+		"example.com/u/u.go": "package u\n\nfunc U() {}\n",
+	})
+
+	// Install v and w, but not d and u.
+	for _, path := range []string{"example.com/v", "example.com/w"} {
+		obj := filepath.Join(pkgDir, filepath.FromSlash(path)+".a")
+		if err := os.MkdirAll(filepath.Dir(obj), 0755); err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Join(src, filepath.FromSlash(path), path[len("example.com/"):]+".go")
+		cmd := exec.Command(filepath.Join(ctx.GOROOT, "bin", "go"), "tool", "compile", "-p", path, "-pack", "-o", obj, name)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Skipf("compiling %s: %v\n%s", path, err, out)
+		}
+	}
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"v/v.go", "v", "w/w.go", "w"} {
+		os.Chtimes(filepath.Join(src, "example.com", filepath.FromSlash(name)), old, old)
+	}
+
+	// In AutoMode, v and w are loaded from their export data, and
+	// d and u, which have none, from source.
+	srcDir := filepath.Join(src, "example.com", "p")
+	paths := []string{"example.com/d", "example.com/u", "example.com/v", "example.com/w"}
+	cache := NewCache()
+	before := importAll(t, cache, &ctx, srcDir, AutoMode, paths...)
+	checkReloaded(t, before, importAll(t, cache, &ctx, srcDir, AutoMode, paths...))
+
+	// Reinstalling v reloads it and d, which depends on it. w is
+	// reloaded too, since it came from the same gc importer as
+	// the old v, but u stays cached.
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(pkgDir, "example.com", "v.a"), future, future)
+	after := importAll(t, cache, &ctx, srcDir, AutoMode, paths...)
+	checkReloaded(t, before, after, "example.com/d", "example.com/v", "example.com/w")
+	if e := cache.Importer(&ctx, filepath.Join(srcDir, "x.go"), AutoMode).part.pkgs["example.com/v"]; e == nil || e.obj == "" {
+		t.Errorf("example.com/v wasn't reloaded from export data")
+	}
+}
+
+func TestDrop(t *testing.T) {
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = t.TempDir()
+	ctx.GO111MODULE = "off"
+
+	src := filepath.Join(ctx.GOPATH, "src")
+	writeFiles(t, src, map[string]string{
+		"example.com/a/a.go":     "package a\n\ntype T int\n",
+		"example.com/b/b.go":     "package b\n\nimport \"example.com/a\"\n\nvar X a.T\n",
+		"example.com/c/c.go":     "package c\n\nimport \"example.com/b\"\n\nvar Y = b.X\n",
+		"example.com/x/a/a.go":   "package a\n\nfunc A() {}\n",
+		"example.com/unrel/u.go": "package unrel\n",
+	})
+	srcDir := filepath.Join(src, "example.com", "p")
+	paths := []string{"example.com/a", "example.com/b", "example.com/c", "example.com/x/a", "example.com/unrel"}
+
+	cache := NewCache()
+	before := importAll(t, cache, &ctx, srcDir, SourceMode, paths...)
+	if n := cache.Len(); n != len(paths) {
+		t.Fatalf("Len() = %d, want %d", n, len(paths))
+	}
+
+	// Dropping a drops the packages that import it, directly or
+	// not, but not other packages, even ones with a path ending
+	// in a.
+	dirs := cache.Drop([]string{"example.com/a"})
+	sort.Strings(dirs)
+	var want []string
+	for _, path := range []string{"example.com/a", "example.com/b", "example.com/c"} {
+		want = append(want, filepath.Join(src, filepath.FromSlash(path)))
+	}
+	if !reflect.DeepEqual(dirs, want) {
+		t.Errorf("Drop returned %q, want %q", dirs, want)
+	}
+	if n := cache.Len(); n != 2 {
+		t.Errorf("Len() after Drop = %d, want 2", n)
+	}
+	after := importAll(t, cache, &ctx, srcDir, SourceMode, paths...)
+	checkReloaded(t, before, after, "example.com/a", "example.com/b", "example.com/c")
+
+	// Dropping nothing in particular drops everything.
+	if dirs := cache.Drop(nil); len(dirs) != len(paths) {
+		t.Errorf("Drop(nil) returned %d directories, want %d", len(dirs), len(paths))
+	}
+	if n := cache.Len(); n != 0 {
+		t.Errorf("Len() after Drop(nil) = %d, want 0", n)
+	}
+	checkReloaded(t, after, importAll(t, cache, &ctx, srcDir, SourceMode, paths...), paths...)
+}
+
+func TestPartitions(t *testing.T) {
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = t.TempDir()
+	ctx.GO111MODULE = "off"
+	writeFiles(t, filepath.Join(ctx.GOPATH, "src"), map[string]string{
+		"example.com/a/a.go": "package a\n",
+	})
+	srcDir := filepath.Join(ctx.GOPATH, "src", "example.com", "p")
+	filename := filepath.Join(srcDir, "x.go")
+
+	cache := NewCache()
+	part := func(ctx PackedContext, mode Mode) *partition {
+		return cache.Importer(&ctx, filename, mode).part
+	}
+
+	// Requests with the same configuration share a partition,
+	// even if they list build tags in a different order.
+	tagged := ctx
+	tagged.BuildTags = []string{"a", "b"}
+	reordered := ctx
+	reordered.BuildTags = []string{"b", "a"}
+	if part(ctx, SourceMode) != part(ctx, SourceMode) || part(tagged, SourceMode) != part(reordered, SourceMode) {
+		t.Errorf("identical configurations use different partitions")
+	}
+
+	windows := ctx
+	windows.GOOS = "windows"
+	others := map[string]*partition{
+		"build tags": part(tagged, SourceMode),
+		"GOOS":       part(windows, SourceMode),
+		"mode":       part(ctx, GCMode),
+	}
+	for what, p := range others {
+		if p == part(ctx, SourceMode) {
+			t.Errorf("configurations differing in %s share a partition", what)
+		}
+	}
+
+	// Importing through one partition doesn't wait for another.
+	held := part(windows, SourceMode)
+	held.mu.Lock()
+	imp := cache.Importer(&ctx, filename, SourceMode)
+	imp.SetDeadline(time.Now().Add(time.Minute))
+	_, err := imp.ImportFrom("example.com/a", srcDir, 0)
+	held.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := cache.Len(); n != 1 {
+		t.Errorf("Len() = %d, want 1", n)
+	}
+}
+
+func TestSlowModule(t *testing.T) {
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = t.TempDir()
+	ctx.GO111MODULE = "off"
+	cache := NewCache()
+
+	// While one request is stuck reading its go.mod file, others
+	// can still get importers.
+	release := make(chan struct{})
+	loaded := make(chan *module)
+	go func() {
+		loaded <- cache.loadModule(&ctx, filepath.Join(ctx.GOPATH, "go.mod"), func(*PackedContext, string) (*module, error) {
+			<-release
+			return &module{file: "slow"}, nil
+		})
+	}()
+	got := make(chan *Importer)
+	go func() {
+		got <- cache.Importer(&ctx, filepath.Join(ctx.GOPATH, "src", "p", "x.go"), SourceMode)
+	}()
+	select {
+	case <-got:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Importer waited for another request's module to load")
+	}
+	close(release)
+	if m := <-loaded; m == nil || m.file != "slow" {
+		t.Errorf("loadModule returned %v", m)
+	}
+}
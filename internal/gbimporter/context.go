@@ -1,8 +1,12 @@
 package gbimporter
 
-import "go/build"
+import (
+	"go/build"
+	"os"
+)
 
-// PackedContext is a copy of build.Context without the func fields.
+// PackedContext is a copy of build.Context without the func fields,
+// plus the module settings from the client's environment.
 //
 // TODO(mdempsky): Not sure this belongs here.
 type PackedContext struct {
@@ -16,6 +20,10 @@ type PackedContext struct {
 	BuildTags     []string
 	ReleaseTags   []string
 	InstallSuffix string
+
+	GO111MODULE string
+	GOMODCACHE  string
+	GOWORK      string
 }
 
 func PackContext(ctx *build.Context) PackedContext {
@@ -30,5 +38,27 @@ func PackContext(ctx *build.Context) PackedContext {
 		BuildTags:     ctx.BuildTags,
 		ReleaseTags:   ctx.ReleaseTags,
 		InstallSuffix: ctx.InstallSuffix,
+
+		GO111MODULE: os.Getenv("GO111MODULE"),
+		GOMODCACHE:  os.Getenv("GOMODCACHE"),
+		GOWORK:      os.Getenv("GOWORK"),
 	}
 }
+
+// BuildContext returns a new build.Context configured like ctx.
+// Unlike build.Default, it can be customized without affecting
+// anything else in the process.
+func (ctx *PackedContext) BuildContext() *build.Context {
+	bctx := build.Default
+	bctx.GOARCH = ctx.GOARCH
+	bctx.GOOS = ctx.GOOS
+	bctx.GOROOT = ctx.GOROOT
+	bctx.GOPATH = ctx.GOPATH
+	bctx.CgoEnabled = ctx.CgoEnabled
+	bctx.UseAllFiles = ctx.UseAllFiles
+	bctx.Compiler = ctx.Compiler
+	bctx.BuildTags = ctx.BuildTags
+	bctx.ReleaseTags = ctx.ReleaseTags
+	bctx.InstallSuffix = ctx.InstallSuffix
+	return &bctx
+}
@@ -1,117 +1,203 @@
 package gbimporter
 
 import (
+	"errors"
 	"fmt"
 	"go/build"
 	"go/types"
 	"path/filepath"
 	"strings"
-	"sync"
+	"time"
 )
 
-// We need to mangle go/build.Default to make gcimporter work as
-// intended, so use a lock to protect against concurrent accesses.
-var buildDefaultLock sync.Mutex
+// ErrDeadline is returned for imports attempted after an Importer's
+// deadline has passed.
+var ErrDeadline = errors.New("import deadline exceeded")
 
-// importer implements types.ImporterFrom and provides transparent
+// An Importer imports packages for a single request on behalf of a
+// Cache. It implements types.ImporterFrom and provides transparent
 // support for gb-based projects.
-type importer struct {
-	underlying types.ImporterFrom
-	ctx        *PackedContext
-	gbroot     string
-	gbpaths    []string
+//
+// Each Importer resolves imports with its own build.Context, so
+// importers for different contexts can be used concurrently.
+type Importer struct {
+	ctx  *PackedContext
+	bctx *build.Context
+	mod  *module
+	part *partition
+
+	// checked records the cached packages already validated
+	// during this request, so shared dependencies are only
+	// stat'ed once.
+	checked map[string]bool
+
+	// depth is the nesting level of ImportFrom calls. Only the
+	// outermost call locks the partition; the source importer
+	// imports dependencies recursively through the same Importer.
+	depth int
+
+	deadline time.Time
+	expired  bool
+
+	// overlay holds the contents of unsaved files.
+	overlay map[string][]byte
 }
 
-func New(ctx *PackedContext, filename string, underlying types.ImporterFrom) types.ImporterFrom {
-	imp := &importer{
-		ctx:        ctx,
-		underlying: underlying,
+// SetDeadline makes imports fail with ErrDeadline once t has passed.
+// A zero t means no deadline.
+func (i *Importer) SetDeadline(t time.Time) {
+	i.deadline = t
+}
+
+// Expired reports whether any imports were refused because the
+// deadline had passed.
+func (i *Importer) Expired() bool {
+	return i.expired
+}
+
+// pastDeadline reports whether the deadline has passed, recording
+// that imports were refused if it has.
+func (i *Importer) pastDeadline() bool {
+	if i.deadline.IsZero() || !time.Now().After(i.deadline) {
+		return false
 	}
+	i.expired = true
+	return true
+}
 
-	slashed := filepath.ToSlash(filename)
-	i := strings.LastIndex(slashed, "/vendor/src/")
-	if i < 0 {
-		i = strings.LastIndex(slashed, "/src/")
+func (i *Importer) Import(path string) (*types.Package, error) {
+	return i.ImportFrom(path, "", 0)
+}
+
+// ImportFrom imports the package with the given import path as seen
+// from srcDir. Outside of modules, that follows the vendoring rules:
+// the innermost vendor directory between srcDir and the root of its
+// GOPATH tree that has a copy of the package wins.
+func (i *Importer) ImportFrom(path, srcDir string, mode types.ImportMode) (*types.Package, error) {
+	if path == "unsafe" {
+		return types.Unsafe, nil
+	}
+	if i.pastDeadline() {
+		return nil, ErrDeadline
+	}
+
+	bp, err := i.findPackage(path, srcDir)
+	if err != nil {
+		return nil, err
 	}
-	if i > 0 {
-		paths := filepath.SplitList(imp.ctx.GOPATH)
 
-		gbroot := filepath.FromSlash(slashed[:i])
-		gbvendor := filepath.Join(gbroot, "vendor")
-		if samePath(gbroot, imp.ctx.GOROOT) {
-			goto Found
+	if i.depth == 0 {
+		// Another request may hold the partition for longer
+		// than we have left.
+		if !i.part.mu.lockBefore(i.deadline) {
+			i.expired = true
+			return nil, ErrDeadline
 		}
-		for _, path := range paths {
-			if samePath(path, gbroot) || samePath(path, gbvendor) {
-				goto Found
-			}
+		defer i.part.mu.Unlock()
+		if i.pastDeadline() {
+			return nil, ErrDeadline
 		}
-
-		imp.gbroot = gbroot
-		imp.gbpaths = append(paths, gbroot, gbvendor)
-	Found:
 	}
+	i.depth++
+	defer func() { i.depth-- }()
 
-	return imp
+	return i.part.importPackage(i, bp)
 }
 
-func (i *importer) Import(path string) (*types.Package, error) {
-	return i.ImportFrom(path, "", 0)
+// findPackage locates the package with the given import path, as
+// imported from srcDir.
+func (i *Importer) findPackage(path, srcDir string) (*build.Package, error) {
+	// Packages in GOROOT, including the ones vendored into the
+	// standard library, never import module packages.
+	if i.mod != nil && !hasFilePathPrefix(srcDir, i.ctx.GOROOT) {
+		dir, err := i.mod.lookup(path)
+		if err != nil {
+			return nil, err
+		}
+		if dir != "" {
+			bp, err := i.bctx.ImportDir(dir, build.FindOnly)
+			if err != nil {
+				return nil, err
+			}
+			bp.ImportPath = path
+			return bp, nil
+		}
+
+		// Outside of the standard library, GOPATH doesn't
+		// count in module mode.
+		if elem := strings.SplitN(path, "/", 2)[0]; strings.Contains(elem, ".") {
+			return nil, fmt.Errorf("no required module provides package %s", path)
+		}
+	}
+	return i.bctx.Import(path, srcDir, build.FindOnly|build.AllowBinary)
 }
 
-func (i *importer) ImportFrom(path, srcDir string, mode types.ImportMode) (*types.Package, error) {
-	buildDefaultLock.Lock()
-	defer buildDefaultLock.Unlock()
-
-	origDef := build.Default
-	defer func() { build.Default = origDef }()
-
-	def := &build.Default
-	def.GOARCH = i.ctx.GOARCH
-	def.GOOS = i.ctx.GOOS
-	def.GOROOT = i.ctx.GOROOT
-	def.GOPATH = i.ctx.GOPATH
-	def.CgoEnabled = i.ctx.CgoEnabled
-	def.UseAllFiles = i.ctx.UseAllFiles
-	def.Compiler = i.ctx.Compiler
-	def.BuildTags = i.ctx.BuildTags
-	def.ReleaseTags = i.ctx.ReleaseTags
-	def.InstallSuffix = i.ctx.InstallSuffix
-
-	def.SplitPathList = i.splitPathList
-	def.JoinPath = i.joinPath
-
-	return i.underlying.ImportFrom(path, srcDir, mode)
+// hasFilePathPrefix reports whether name is within dir.
+func hasFilePathPrefix(name, dir string) bool {
+	if name == "" || dir == "" {
+		return false
+	}
+	rel, err := filepath.Rel(dir, name)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
 
-func (i *importer) splitPathList(list string) []string {
-	if i.gbroot != "" {
-		return i.gbpaths
+// buildContext returns a build.Context for resolving imports from
+// filename under ctx, and the gb project root if filename belongs to
+// a gb project.
+func buildContext(ctx *PackedContext, filename string) (*build.Context, string) {
+	bctx := ctx.BuildContext()
+
+	slashed := filepath.ToSlash(filename)
+	i := strings.LastIndex(slashed, "/vendor/src/")
+	if i < 0 {
+		i = strings.LastIndex(slashed, "/src/")
+	}
+	if i <= 0 {
+		return bctx, ""
+	}
+
+	paths := filepath.SplitList(ctx.GOPATH)
+
+	gbroot := filepath.FromSlash(slashed[:i])
+	gbvendor := filepath.Join(gbroot, "vendor")
+	if samePath(gbroot, ctx.GOROOT) {
+		return bctx, ""
+	}
+	for _, path := range paths {
+		if samePath(path, gbroot) || samePath(path, gbvendor) {
+			return bctx, ""
+		}
+	}
+
+	gbpaths := append(paths, gbroot, gbvendor)
+	bctx.SplitPathList = func(list string) []string {
+		return gbpaths
+	}
+	bctx.JoinPath = func(elem ...string) string {
+		return gbJoinPath(ctx, gbroot, elem...)
 	}
-	return filepath.SplitList(list)
+	return bctx, gbroot
 }
 
-func (i *importer) joinPath(elem ...string) string {
+func gbJoinPath(ctx *PackedContext, gbroot string, elem ...string) string {
 	res := filepath.Join(elem...)
 
-	if i.gbroot != "" {
-		// Want to rewrite "$GBROOT/(vendor/)?pkg/$GOOS_$GOARCH(_)?"
-		// into "$GBROOT/pkg/$GOOS-$GOARCH(-)?".
-		// Note: gb doesn't use vendor/pkg.
-		if gbrel, err := filepath.Rel(i.gbroot, res); err == nil {
-			gbrel = filepath.ToSlash(gbrel)
-			gbrel, _ = match(gbrel, "vendor/")
-			if gbrel, ok := match(gbrel, fmt.Sprintf("pkg/%s_%s", i.ctx.GOOS, i.ctx.GOARCH)); ok {
-				gbrel, hasSuffix := match(gbrel, "_")
-
-				// Reassemble into result.
-				if hasSuffix {
-					gbrel = "-" + gbrel
-				}
-				gbrel = fmt.Sprintf("pkg/%s-%s/", i.ctx.GOOS, i.ctx.GOARCH) + gbrel
-				gbrel = filepath.FromSlash(gbrel)
-				res = filepath.Join(i.gbroot, gbrel)
+	// Want to rewrite "$GBROOT/(vendor/)?pkg/$GOOS_$GOARCH(_)?"
+	// into "$GBROOT/pkg/$GOOS-$GOARCH(-)?".
+	// Note: gb doesn't use vendor/pkg.
+	if gbrel, err := filepath.Rel(gbroot, res); err == nil {
+		gbrel = filepath.ToSlash(gbrel)
+		gbrel, _ = match(gbrel, "vendor/")
+		if gbrel, ok := match(gbrel, fmt.Sprintf("pkg/%s_%s", ctx.GOOS, ctx.GOARCH)); ok {
+			gbrel, hasSuffix := match(gbrel, "_")
+
+			// Reassemble into result.
+			if hasSuffix {
+				gbrel = "-" + gbrel
 			}
+			gbrel = fmt.Sprintf("pkg/%s-%s/", ctx.GOOS, ctx.GOARCH) + gbrel
+			gbrel = filepath.FromSlash(gbrel)
+			res = filepath.Join(gbroot, gbrel)
 		}
 	}
 
@@ -0,0 +1,364 @@
+package gbimporter
+
+import (
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVendor(t *testing.T) {
+	gopath, err := filepath.Abs("testdata/gopath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = gopath
+	ctx.GO111MODULE = "off"
+
+	tests := []struct {
+		srcDir string
+		path   string
+		want   string
+	}{
+		{"example.com/p", "example.com/v", "example.com/p/vendor/example.com/v [Outer]"},
+		{"example.com/p/sub", "example.com/v", "example.com/p/sub/vendor/example.com/v [Inner]"},
+		{"example.com/p/sub/deep", "example.com/v", "example.com/p/sub/vendor/example.com/v [Inner]"},
+		{"example.com/v", "example.com/v", "example.com/v [GOPATH]"},
+
+		// Vendor directories without Go files don't shadow
+		// anything.
+		{"example.com/p", "example.com/empty", "example.com/empty [GOPATH]"},
+	}
+	// There's no export data for GOPATH packages that haven't
+	// been installed, so import from source.
+	cache := NewCache()
+	for _, test := range tests {
+		srcDir := filepath.Join(gopath, "src", filepath.FromSlash(test.srcDir))
+		imp := cache.Importer(&ctx, filepath.Join(srcDir, "x.go"), SourceMode)
+		pkg, err := imp.ImportFrom(test.path, srcDir, 0)
+		if err != nil {
+			t.Errorf("import %s from %s: %v", test.path, test.srcDir, err)
+			continue
+		}
+		if got := fmt.Sprint(pkg.Path(), " ", pkg.Scope().Names()); got != test.want {
+			t.Errorf("import %s from %s: got %s, want %s", test.path, test.srcDir, got, test.want)
+		}
+	}
+}
+
+func TestImportPaths(t *testing.T) {
+	gopath, err := filepath.Abs("testdata/gopath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = gopath
+	ctx.GO111MODULE = "off"
+
+	tests := []struct {
+		srcDir string
+		path   string
+		want   string // "" if srcDir can't import path
+	}{
+		{"example.com/p", "example.com/v", "example.com/p/vendor/example.com/v"},
+		{"example.com/p/sub/deep", "example.com/v", "example.com/p/sub/vendor/example.com/v"},
+		{"example.com/v", "example.com/v", "example.com/v"},
+		{"example.com/p", "example.com/empty", "example.com/empty"},
+		{"example.com/p", "example.com/empty/inner", "example.com/p/vendor/example.com/empty/inner"},
+		{"example.com/v", "example.com/empty/inner", ""},
+	}
+	cache := NewCache()
+	for _, test := range tests {
+		srcDir := filepath.Join(gopath, "src", filepath.FromSlash(test.srcDir))
+		imp := cache.Importer(&ctx, filepath.Join(srcDir, "x.go"), SourceMode)
+		paths := imp.ImportPaths(srcDir)
+		want := ""
+		if test.want != "" {
+			want = filepath.Join(gopath, "src", filepath.FromSlash(test.want))
+		}
+		if got := paths[test.path]; got != want {
+			t.Errorf("ImportPaths(%s)[%q] = %q, want %q", test.srcDir, test.path, got, want)
+		}
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	gopath, err := filepath.Abs("testdata/gopath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = gopath
+	ctx.GO111MODULE = "off"
+
+	dir := filepath.Join(gopath, "src", "example.com", "v")
+	overlay := map[string][]byte{
+		filepath.Join(dir, "v.go"):   []byte("package v\n\nfunc Unsaved() {}\n"),
+		filepath.Join(dir, "new.go"): []byte("package v\n\nfunc New() {}\n"),
+	}
+
+	tests := []struct {
+		mode    Mode
+		overlay map[string][]byte
+		want    string
+	}{
+		{SourceMode, overlay, "[New Unsaved]"},
+		{SourceMode, nil, "[GOPATH]"},
+		{SourceMode, overlay, "[New Unsaved]"},
+
+		// There's no export data for example.com/v, but
+		// overlaid packages are imported from source anyway.
+		{GCMode, overlay, "[New Unsaved]"},
+	}
+	cache := NewCache()
+	for i, test := range tests {
+		imp := cache.Importer(&ctx, filepath.Join(gopath, "src", "example.com", "p", "p.go"), test.mode)
+		imp.SetOverlay(test.overlay)
+		pkg, err := imp.Import("example.com/v")
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		if got := fmt.Sprint(pkg.Scope().Names()); got != test.want {
+			t.Errorf("%d: got %s, want %s", i, got, test.want)
+		}
+	}
+}
+
+func TestAutoMode(t *testing.T) {
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = t.TempDir()
+	ctx.GO111MODULE = "off"
+
+	// Stand in for example.com/v's installed export data with
+	// the export data of a standard library package.
+	export, err := goListExport(&ctx, "errors", time.Time{})
+	if err != nil {
+		t.Skip(err)
+	}
+	data, err := ioutil.ReadFile(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(ctx.GOPATH, "src", "example.com", "v")
+	obj := filepath.Join(ctx.GOPATH, "pkg", ctx.GOOS+"_"+ctx.GOARCH, "example.com", "v.a")
+	for _, d := range []string{dir, filepath.Dir(obj)} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "v.go"), []byte("package v\n\nfunc Source() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srcTime := time.Now().Add(-time.Hour)
+	for _, name := range []string{filepath.Join(dir, "v.go"), dir} {
+		if err := os.Chtimes(name, srcTime, srcTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		desc    string
+		obj     []byte
+		objTime time.Time
+		mode    Mode
+		source  bool
+	}{
+		{"missing", nil, time.Time{}, AutoMode, true},
+		{"fresh", data, time.Now(), AutoMode, false},
+		{"stale", data, srcTime.Add(-time.Hour), AutoMode, true},
+		{"incompatible", []byte("!<arch>\ngarbage\n"), time.Now(), AutoMode, true},
+
+		// Without AutoMode, stale export data is used as is.
+		{"stale gc", data, srcTime.Add(-time.Hour), GCMode, false},
+	}
+	for _, test := range tests {
+		os.Remove(obj)
+		if test.obj != nil {
+			if err := ioutil.WriteFile(obj, test.obj, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(obj, test.objTime, test.objTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		imp := NewCache().Importer(&ctx, filepath.Join(ctx.GOPATH, "src", "example.com", "p", "p.go"), test.mode)
+		pkg, err := imp.Import("example.com/v")
+		if err != nil {
+			t.Errorf("%s: %v", test.desc, err)
+			continue
+		}
+		if source := pkg.Scope().Lookup("Source") != nil; source != test.source {
+			t.Errorf("%s: imported from source = %v, want %v", test.desc, source, test.source)
+		}
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = t.TempDir()
+	ctx.GO111MODULE = "off"
+	writeFiles(t, filepath.Join(ctx.GOPATH, "src"), map[string]string{
+		"example.com/a/a.go": "package a\n",
+	})
+	srcDir := filepath.Join(ctx.GOPATH, "src", "example.com", "p")
+	cache := NewCache()
+
+	// An import stuck behind another request's import gives up
+	// when its deadline passes.
+	holder := cache.Importer(&ctx, filepath.Join(srcDir, "x.go"), SourceMode)
+	holder.part.mu.Lock()
+	imp := cache.Importer(&ctx, filepath.Join(srcDir, "x.go"), SourceMode)
+	start := time.Now()
+	imp.SetDeadline(start.Add(50 * time.Millisecond))
+	if _, err := imp.ImportFrom("example.com/a", srcDir, 0); err != ErrDeadline {
+		t.Errorf("import behind a held partition returned %v, want %v", err, ErrDeadline)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("import gave up after %v", elapsed)
+	}
+	if !imp.Expired() {
+		t.Errorf("Expired() = false after an import ran out of time")
+	}
+	holder.part.mu.Unlock()
+
+	// Without the other request, the import succeeds.
+	imp = cache.Importer(&ctx, filepath.Join(srcDir, "x.go"), SourceMode)
+	imp.SetDeadline(time.Now().Add(time.Minute))
+	if _, err := imp.ImportFrom("example.com/a", srcDir, 0); err != nil || imp.Expired() {
+		t.Errorf("import returned %v, Expired() = %v", err, imp.Expired())
+	}
+
+	// The go command is stopped at the deadline too.
+	if _, err := goListExports(&ctx, srcDir, "errors", false, time.Now().Add(-time.Second)); err != ErrDeadline {
+		t.Errorf("go list past the deadline returned %v, want %v", err, ErrDeadline)
+	}
+}
+
+func TestPackageIndex(t *testing.T) {
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = t.TempDir()
+	ctx.GO111MODULE = "off"
+	src := filepath.Join(ctx.GOPATH, "src")
+	writeFiles(t, src, map[string]string{
+		"example.com/a/a.go":            "// Package a does things.\npackage a\n",
+		"example.com/a/internal/i/i.go": "package i\n",
+	})
+	srcDir := filepath.Join(src, "example.com", "p")
+	cache := NewCache()
+	imp := cache.Importer(&ctx, filepath.Join(srcDir, "x.go"), SourceMode)
+	spec := treeSpec{root: src, gopath: true}
+
+	paths := func(srcDir string) map[string]string {
+		t.Helper()
+		// Each request uses an Importer of its own.
+		return cache.Importer(&ctx, filepath.Join(srcDir, "x.go"), SourceMode).ImportPaths(srcDir)
+	}
+	if got := paths(srcDir); got["example.com/a"] == "" || got["example.com/a/internal/i"] != "" {
+		t.Errorf("ImportPaths(%s) = %v", srcDir, got)
+	}
+	tree := imp.part.index.trees[spec]
+	if tree == nil {
+		t.Fatalf("GOPATH wasn't indexed")
+	}
+	if got := paths(filepath.Join(src, "example.com", "a")); got["example.com/a/internal/i"] == "" {
+		t.Errorf("example.com/a can't import its internal package")
+	}
+	if imp.part.index.trees[spec] != tree {
+		t.Errorf("GOPATH was walked again")
+	}
+
+	// New packages are found once the index is rechecked.
+	writeFiles(t, src, map[string]string{
+		"example.com/b/b.go": "package b\n",
+	})
+	if got := paths(srcDir); got["example.com/b"] != "" {
+		t.Errorf("index was rechecked early")
+	}
+	tree.checked = time.Time{}
+	if got := paths(srcDir); got["example.com/b"] == "" {
+		t.Errorf("new package example.com/b wasn't found")
+	}
+
+	// Unchanged trees are kept after a recheck.
+	tree = imp.part.index.trees[spec]
+	tree.checked = time.Time{}
+	paths(srcDir)
+	if imp.part.index.trees[spec] != tree {
+		t.Errorf("unchanged GOPATH was walked again")
+	}
+
+	if name, doc := imp.PackageDoc(filepath.Join(src, "example.com", "a")); name != "a" || doc != "Package a does things." {
+		t.Errorf("PackageDoc = %q, %q", name, doc)
+	}
+	if got := imp.FindPackage("b", srcDir); got != "example.com/b" {
+		t.Errorf("FindPackage(b) = %q, want example.com/b", got)
+	}
+
+	cache.Drop([]string{"example.com/a"})
+	if imp.part.index != nil {
+		t.Errorf("index survived Drop")
+	}
+}
+
+func TestPackageIndexWalk(t *testing.T) {
+	ctx := PackContext(&build.Default)
+	ctx.GOPATH = t.TempDir()
+	ctx.GO111MODULE = "off"
+	src := filepath.Join(ctx.GOPATH, "src")
+	writeFiles(t, src, map[string]string{
+		"example.com/a/a.go": "package a\n",
+	})
+	srcDir := filepath.Join(src, "example.com", "p")
+	imp := NewCache().Importer(&ctx, filepath.Join(srcDir, "x.go"), SourceMode)
+	imp.Packages(srcDir)
+
+	// Pretend another request is walking GOPATH.
+	spec := treeSpec{root: src, gopath: true}
+	walking := &packageTree{
+		done:    make(chan struct{}),
+		checked: time.Now(),
+	}
+	imp.part.indexMu.Lock()
+	imp.part.index.trees[spec] = walking
+	imp.part.indexMu.Unlock()
+
+	// The index isn't locked during the walk.
+	doc := make(chan string)
+	go func() {
+		name, _ := imp.PackageDoc(filepath.Join(src, "example.com", "a"))
+		doc <- name
+	}()
+	select {
+	case name := <-doc:
+		if name != "a" {
+			t.Errorf("PackageDoc = %q, want a", name)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("PackageDoc waited for the walk")
+	}
+
+	// Other requests wait for the walk rather than walking GOPATH
+	// themselves.
+	found := make(chan map[string]string)
+	go func() {
+		found <- imp.ImportPaths(srcDir)
+	}()
+	select {
+	case <-found:
+		t.Fatal("ImportPaths didn't wait for the walk")
+	case <-time.After(100 * time.Millisecond):
+	}
+	walking.pkgs = []indexedPackage{{PackageDir: PackageDir{Path: "example.com/walked", Dir: filepath.Join(src, "example.com", "walked")}}}
+	walking.dirs = map[string]time.Time{src: fileStamp(src)}
+	close(walking.done)
+	if got := <-found; got["example.com/walked"] == "" || got["example.com/a"] != "" {
+		t.Errorf("ImportPaths didn't use the walked tree: %v", got)
+	}
+}
@@ -0,0 +1,86 @@
+package gbimporter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// goListExport asks the go command to locate (building it into the
+// build cache if necessary) the export data for the package with
+// the given import path.
+func goListExport(ctx *PackedContext, path string, deadline time.Time) (string, error) {
+	exports, err := goListExports(ctx, filepath.Join(ctx.GOROOT, "src"), path, false, deadline)
+	if err != nil {
+		return "", err
+	}
+	export := exports[path]
+	if export == "" {
+		return "", fmt.Errorf("can't find export data for %q", path)
+	}
+	return export, nil
+}
+
+// goListExports runs go list -export in dir for the package with the
+// given import path, and for all its dependencies if deps is set. It
+// returns the export data file of each listed package, keyed by
+// import path, or "" for packages that failed to build.
+//
+// The go command is never allowed to download modules or
+// toolchains, so requirements missing from the module cache make it
+// fail instead. It's killed once deadline passes, unless deadline is
+// zero, and goListExports returns ErrDeadline.
+func goListExports(ctx *PackedContext, dir, path string, deps bool, deadline time.Time) (map[string]string, error) {
+	args := []string{"list", "-e", "-export", "-f", "{{.ImportPath}}\t{{.Export}}"}
+	if deps {
+		args = append(args, "-deps")
+	}
+	if len(ctx.BuildTags) > 0 {
+		args = append(args, "-tags", strings.Join(ctx.BuildTags, ","))
+	}
+	args = append(args, "--", path)
+
+	cctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		cctx, cancel = context.WithDeadline(cctx, deadline)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(cctx, filepath.Join(ctx.GOROOT, "bin", "go"), args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GOROOT="+ctx.GOROOT,
+		"GOPATH="+ctx.GOPATH,
+		"GOOS="+ctx.GOOS,
+		"GOARCH="+ctx.GOARCH,
+		"CGO_ENABLED="+boolKey(ctx.CgoEnabled),
+		"GO111MODULE="+ctx.GO111MODULE,
+		"GOMODCACHE="+ctx.GOMODCACHE,
+		"GOWORK="+ctx.GOWORK,
+		"GOFLAGS=",
+		"GOPROXY=off",
+		"GOTOOLCHAIN=local",
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil && cctx.Err() != nil {
+		return nil, ErrDeadline
+	}
+	if err != nil {
+		return nil, fmt.Errorf("go list -export %s: %v: %s", path, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	exports := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		if f := strings.SplitN(line, "\t", 2); len(f) == 2 {
+			exports[f[0]] = f[1]
+		}
+	}
+	return exports, nil
+}
@@ -0,0 +1,295 @@
+package gbimporter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A modFile holds the parts of a go.mod file that matter for
+// resolving imports.
+type modFile struct {
+	module    string
+	goVersion string
+	require   []moduleVersion
+	replace   []modReplace
+}
+
+type moduleVersion struct {
+	path    string
+	version string
+}
+
+// A modReplace is a replace directive. If old.version is empty, it
+// replaces all versions of old.path. If new.version is empty,
+// new.path is a directory.
+type modReplace struct {
+	old moduleVersion
+	new moduleVersion
+}
+
+// A workFile holds the parts of a go.work file that matter for
+// resolving imports.
+type workFile struct {
+	goVersion string
+	use       []string
+	replace   []modReplace
+}
+
+// parseModFile parses the contents of a go.mod file. Directives that
+// don't affect import resolution are ignored.
+func parseModFile(data []byte) (*modFile, error) {
+	f := new(modFile)
+	if err := parseDirectives(data, f.directive); err != nil {
+		return nil, err
+	}
+	if f.module == "" {
+		return nil, fmt.Errorf("no module directive")
+	}
+	return f, nil
+}
+
+// parseWorkFile parses the contents of a go.work file.
+func parseWorkFile(data []byte) (*workFile, error) {
+	f := new(workFile)
+	err := parseDirectives(data, func(verb string, args []string) {
+		switch verb {
+		case "go":
+			if len(args) == 1 {
+				f.goVersion = args[0]
+			}
+		case "use":
+			if len(args) == 1 {
+				f.use = append(f.use, args[0])
+			}
+		case "replace":
+			if r, ok := parseReplace(args); ok {
+				f.replace = append(f.replace, r)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseDirectives calls directive for each directive in a go.mod or
+// go.work file, unfolding blocks like "require ( ... )".
+func parseDirectives(data []byte, directive func(verb string, args []string)) error {
+	var block string
+	for n, line := range strings.Split(string(data), "\n") {
+		fields, err := modFields(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", n+1, err)
+		}
+		switch {
+		case len(fields) == 0:
+		case block != "" && fields[0] == ")":
+			block = ""
+		case block != "":
+			directive(block, fields)
+		case len(fields) == 2 && fields[1] == "(":
+			block = fields[0]
+		default:
+			directive(fields[0], fields[1:])
+		}
+	}
+	return nil
+}
+
+func (f *modFile) directive(verb string, args []string) {
+	switch verb {
+	case "module":
+		if len(args) == 1 {
+			f.module = args[0]
+		}
+	case "go":
+		if len(args) == 1 {
+			f.goVersion = args[0]
+		}
+	case "require":
+		if len(args) == 2 {
+			f.require = append(f.require, moduleVersion{args[0], args[1]})
+		}
+	case "replace":
+		if r, ok := parseReplace(args); ok {
+			f.replace = append(f.replace, r)
+		}
+	}
+}
+
+// parseReplace parses the arguments of a replace directive.
+func parseReplace(args []string) (modReplace, bool) {
+	var r modReplace
+	switch {
+	case len(args) >= 3 && args[1] == "=>":
+		r.old = moduleVersion{path: args[0]}
+		args = args[2:]
+	case len(args) >= 4 && args[2] == "=>":
+		r.old = moduleVersion{args[0], args[1]}
+		args = args[3:]
+	default:
+		return r, false
+	}
+	switch len(args) {
+	case 1:
+		r.new = moduleVersion{path: args[0]}
+	case 2:
+		r.new = moduleVersion{args[0], args[1]}
+	default:
+		return r, false
+	}
+	return r, true
+}
+
+// modFields splits a go.mod line into its tokens, dropping comments
+// and unquoting quoted strings.
+func modFields(line string) ([]string, error) {
+	var fields []string
+	for {
+		line = strings.TrimLeftFunc(line, unicode.IsSpace)
+		if line == "" || strings.HasPrefix(line, "//") {
+			return fields, nil
+		}
+
+		var tok string
+		switch line[0] {
+		case '"', '`':
+			end := 1
+			for end < len(line) && line[end] != line[0] {
+				if line[0] == '"' && line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			s, err := strconv.Unquote(line[:end+1])
+			if err != nil {
+				return nil, err
+			}
+			tok, line = s, line[end+1:]
+		default:
+			end := strings.IndexFunc(line, unicode.IsSpace)
+			if end < 0 {
+				end = len(line)
+			}
+			if i := strings.Index(line[:end], "//"); i >= 0 {
+				end = i
+			}
+			tok, line = line[:end], line[end:]
+		}
+		fields = append(fields, tok)
+	}
+}
+
+// escapeModulePath escapes a module path or version the way the
+// module cache does, replacing each upper-case letter with an
+// exclamation mark followed by its lower-case form.
+func escapeModulePath(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if 'A' <= r && r <= 'Z' {
+			b.WriteByte('!')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// compareVersions compares two semantic versions such as "v1.2.3" or
+// "v0.0.0-20180101000000-abcdef012345", returning -1, 0 or +1. Build
+// metadata like "+incompatible" is ignored.
+func compareVersions(v, w string) int {
+	vn, vpre := splitVersion(v)
+	wn, wpre := splitVersion(w)
+	for i := range vn {
+		if c := compareNumbers(vn[i], wn[i]); c != 0 {
+			return c
+		}
+	}
+
+	// A version without a prerelease sorts after the versions
+	// with one.
+	switch {
+	case vpre == wpre:
+		return 0
+	case vpre == "":
+		return +1
+	case wpre == "":
+		return -1
+	}
+
+	vids, wids := strings.Split(vpre, "."), strings.Split(wpre, ".")
+	for i := 0; i < len(vids) && i < len(wids); i++ {
+		if c := comparePrerelease(vids[i], wids[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(vids), len(wids))
+}
+
+// splitVersion returns the major, minor and patch numbers and the
+// prerelease part of v.
+func splitVersion(v string) (nums [3]string, pre string) {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexByte(v, '+'); i >= 0 {
+		v = v[:i]
+	}
+	if i := strings.IndexByte(v, '-'); i >= 0 {
+		v, pre = v[:i], v[i+1:]
+	}
+	parts := strings.SplitN(v, ".", 3)
+	for i := range nums {
+		nums[i] = "0"
+		if i < len(parts) && parts[i] != "" {
+			nums[i] = parts[i]
+		}
+	}
+	return nums, pre
+}
+
+func comparePrerelease(x, y string) int {
+	xnum, ynum := isNumber(x), isNumber(y)
+	switch {
+	case xnum && ynum:
+		return compareNumbers(x, y)
+	case xnum:
+		return -1
+	case ynum:
+		return +1
+	}
+	return strings.Compare(x, y)
+}
+
+// compareNumbers compares two decimal numbers of any length.
+func compareNumbers(x, y string) int {
+	x, y = strings.TrimLeft(x, "0"), strings.TrimLeft(y, "0")
+	if c := compareInts(len(x), len(y)); c != 0 {
+		return c
+	}
+	return strings.Compare(x, y)
+}
+
+func compareInts(x, y int) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return +1
+	}
+	return 0
+}
+
+func isNumber(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,359 @@
+package gbimporter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A module describes how imports are resolved for files in a main
+// module: the module containing the file being completed, whose
+// go.mod determines the versions of its dependencies. In workspace
+// mode, there are several main modules, listed in a go.work file.
+type module struct {
+	// file is the go.mod or go.work file that m is for, and dir
+	// is its directory.
+	file string
+	dir  string
+
+	// mains holds the paths of the main modules.
+	mains map[string]bool
+
+	// deps maps the path of each module in the build list,
+	// including the main modules, to the directory holding its
+	// source. The directory may not exist if the module hasn't
+	// been downloaded.
+	deps map[string]string
+
+	// vendor is set if dependencies are resolved through the main
+	// module's vendor directory instead of deps.
+	vendor bool
+
+	// replace holds the replace directives in effect. Replacement
+	// directories are absolute.
+	replace  []modReplace
+	modcache string
+
+	// stamps records the modification times of the go.mod and
+	// go.work files that m was loaded from.
+	stamps map[string]time.Time
+}
+
+// findFile returns the file with the given name in dir or its
+// closest parent directory that has one, or "" if there isn't one.
+func findFile(dir, name string) string {
+	for {
+		if file := filepath.Join(dir, name); isFile(file) {
+			return file
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// modCacheDir returns the module cache directory for ctx.
+func modCacheDir(ctx *PackedContext) string {
+	if ctx.GOMODCACHE != "" {
+		return ctx.GOMODCACHE
+	}
+	if paths := filepath.SplitList(ctx.GOPATH); len(paths) > 0 {
+		return filepath.Join(paths[0], "pkg", "mod")
+	}
+	return ""
+}
+
+func newModule(ctx *PackedContext, file string) *module {
+	return &module{
+		file:     file,
+		dir:      filepath.Dir(file),
+		mains:    make(map[string]bool),
+		deps:     make(map[string]string),
+		modcache: modCacheDir(ctx),
+		stamps:   make(map[string]time.Time),
+	}
+}
+
+// loadModule loads the main module described by gomod and computes
+// its build list. It never touches the network: dependencies'
+// requirements are read from the module cache, and modules missing
+// from it are simply left out of the module graph.
+func loadModule(ctx *PackedContext, gomod string) (*module, error) {
+	m := newModule(ctx, gomod)
+	mf, err := m.readModFile(gomod)
+	if err != nil {
+		return nil, err
+	}
+	m.replace = mf.replace
+
+	// Since Go 1.14, the go command uses the vendor directory by
+	// default if there is one.
+	if goVersionAtLeast(mf.goVersion, 14) && isFile(filepath.Join(m.dir, "vendor", "modules.txt")) {
+		m.vendor = true
+		return m, nil
+	}
+
+	// Since Go 1.17, go.mod lists every module that provides a
+	// package imported by the main module, directly or not, so
+	// there's no need to walk the module graph.
+	m.addBuildList(mf.require, goVersionAtLeast(mf.goVersion, 17))
+	return m, nil
+}
+
+// loadWorkspace loads the workspace described by gowork, whose main
+// modules are the ones it uses. Like loadModule, it works offline.
+func loadWorkspace(ctx *PackedContext, gowork string) (*module, error) {
+	m := newModule(ctx, gowork)
+	m.stamps[gowork] = fileStamp(gowork)
+	data, err := ioutil.ReadFile(gowork)
+	if err != nil {
+		return nil, err
+	}
+	wf, err := parseWorkFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", gowork, err)
+	}
+
+	// Replacements in go.work take precedence over the ones in
+	// the main modules' go.mod files.
+	m.replace = absReplace(m.dir, wf.replace)
+	replaced := make(map[string]bool)
+	for _, r := range wf.replace {
+		replaced[r.old.path] = true
+	}
+
+	var reqs []moduleVersion
+	pruned := true
+	for _, use := range wf.use {
+		mf, err := m.readModFile(filepath.Join(localDir(m.dir, use), "go.mod"))
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, mf.require...)
+		pruned = pruned && goVersionAtLeast(mf.goVersion, 17)
+		for _, r := range mf.replace {
+			if !replaced[r.old.path] {
+				m.replace = append(m.replace, r)
+			}
+		}
+	}
+	m.addBuildList(reqs, pruned)
+	return m, nil
+}
+
+// readModFile reads gomod and adds the module it describes to m's
+// main modules.
+func (m *module) readModFile(gomod string) (*modFile, error) {
+	m.stamps[gomod] = fileStamp(gomod)
+	data, err := ioutil.ReadFile(gomod)
+	if err != nil {
+		return nil, err
+	}
+	mf, err := parseModFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", gomod, err)
+	}
+	mf.replace = absReplace(filepath.Dir(gomod), mf.replace)
+	m.mains[mf.module] = true
+	m.deps[mf.module] = filepath.Dir(gomod)
+	return mf, nil
+}
+
+// absReplace returns replace with replacement directories made
+// absolute, relative to dir.
+func absReplace(dir string, replace []modReplace) []modReplace {
+	res := make([]modReplace, len(replace))
+	for i, r := range replace {
+		if r.new.version == "" {
+			r.new.path = localDir(dir, r.new.path)
+		}
+		res[i] = r
+	}
+	return res
+}
+
+// contains reports whether the module rooted at dir is one of m's
+// main modules.
+func (m *module) contains(dir string) bool {
+	for path := range m.mains {
+		if m.deps[path] == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// stale reports whether any of the files m was loaded from have
+// changed.
+func (m *module) stale() bool {
+	for name, stamp := range m.stamps {
+		if !fileStamp(name).Equal(stamp) {
+			return true
+		}
+	}
+	return false
+}
+
+// addBuildList adds the modules in the build list for reqs to m.deps.
+func (m *module) addBuildList(reqs []moduleVersion, pruned bool) {
+	for _, mv := range m.buildList(reqs, pruned) {
+		m.deps[mv.path] = m.sourceDir(mv)
+	}
+}
+
+// buildList returns the module versions selected by minimal version
+// selection from the module graph rooted at reqs: the highest
+// version of each module that's required anywhere in the graph.
+func (m *module) buildList(reqs []moduleVersion, pruned bool) []moduleVersion {
+	selected := make(map[string]string)
+	seen := make(map[moduleVersion]bool)
+	for len(reqs) > 0 {
+		mv := reqs[0]
+		reqs = reqs[1:]
+		if seen[mv] || m.mains[mv.path] {
+			continue
+		}
+		seen[mv] = true
+
+		if v, ok := selected[mv.path]; !ok || compareVersions(mv.version, v) > 0 {
+			selected[mv.path] = mv.version
+		}
+		if pruned {
+			continue
+		}
+		data, err := ioutil.ReadFile(m.goModFile(mv))
+		if err != nil {
+			continue
+		}
+		if f, err := parseModFile(data); err == nil {
+			reqs = append(reqs, f.require...)
+		}
+	}
+
+	list := make([]moduleVersion, 0, len(selected))
+	for path, version := range selected {
+		list = append(list, moduleVersion{path, version})
+	}
+	return list
+}
+
+// replacement returns the replacement for mv, if there is one.
+func (m *module) replacement(mv moduleVersion) (moduleVersion, bool) {
+	var found *modReplace
+	for i := range m.replace {
+		r := &m.replace[i]
+		if r.old.path != mv.path {
+			continue
+		}
+		if r.old.version == mv.version {
+			return r.new, true
+		}
+		if r.old.version == "" {
+			found = r
+		}
+	}
+	if found != nil {
+		return found.new, true
+	}
+	return moduleVersion{}, false
+}
+
+// sourceDir returns the directory holding the source of mv.
+func (m *module) sourceDir(mv moduleVersion) string {
+	if r, ok := m.replacement(mv); ok {
+		if r.version == "" {
+			return r.path
+		}
+		mv = r
+	}
+	return filepath.Join(m.modcache, filepath.FromSlash(escapeModulePath(mv.path)+"@"+escapeModulePath(mv.version)))
+}
+
+// goModFile returns the name of the go.mod file listing mv's
+// requirements.
+func (m *module) goModFile(mv moduleVersion) string {
+	if r, ok := m.replacement(mv); ok {
+		if r.version == "" {
+			return filepath.Join(r.path, "go.mod")
+		}
+		mv = r
+	}
+
+	// The module cache keeps go.mod files separately from module
+	// sources, so they're available even for modules that were
+	// never downloaded in full.
+	name := filepath.Join(m.modcache, "cache", "download", filepath.FromSlash(escapeModulePath(mv.path)), "@v", escapeModulePath(mv.version)+".mod")
+	if isFile(name) {
+		return name
+	}
+	return filepath.Join(m.sourceDir(mv), "go.mod")
+}
+
+// localDir returns the directory named by path in a replace or use
+// directive of a file in dir.
+func localDir(dir, path string) string {
+	path = filepath.FromSlash(path)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	return path
+}
+
+// lookup returns the directory of the package with the given import
+// path, or "" if no module in the build list provides it.
+func (m *module) lookup(path string) (string, error) {
+	var missing string
+	for prefix := path; ; {
+		if root, ok := m.deps[prefix]; ok {
+			dir := filepath.Join(root, filepath.FromSlash(strings.TrimPrefix(path, prefix)))
+			if isDir(dir) {
+				return dir, nil
+			}
+			if missing == "" && !isDir(root) {
+				missing = prefix
+			}
+		}
+		i := strings.LastIndex(prefix, "/")
+		if i < 0 {
+			break
+		}
+		prefix = prefix[:i]
+	}
+
+	if m.vendor {
+		if dir := filepath.Join(m.dir, "vendor", filepath.FromSlash(path)); isDir(dir) {
+			return dir, nil
+		}
+	}
+	if missing != "" {
+		return "", fmt.Errorf("module %s providing package %s is not in the module cache (%s)", missing, path, m.deps[missing])
+	}
+	return "", nil
+}
+
+// goVersionAtLeast reports whether the go directive version v, such
+// as "1.21" or "1.21.3", is at least Go 1.minor.
+func goVersionAtLeast(v string, minor int) bool {
+	parts := strings.SplitN(v, ".", 3)
+	if len(parts) < 2 || parts[0] != "1" {
+		return parts[0] > "1"
+	}
+	n, err := strconv.Atoi(parts[1])
+	return err == nil && n >= minor
+}
+
+func isDir(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && fi.IsDir()
+}
+
+func isFile(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && !fi.IsDir()
+}
@@ -0,0 +1,257 @@
+package gbimporter
+
+import (
+	"fmt"
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseModFile(t *testing.T) {
+	const gomod = `
+module "example.com/m" // comment
+
+go 1.21
+
+require example.com/a v1.0.0
+require (
+	example.com/b v1.2.3 // indirect
+	` + "`example.com/c`" + ` v0.1.0
+)
+
+replace example.com/a => ../a
+replace (
+	example.com/b v1.2.3 => example.com/fork v1.2.4
+)
+exclude example.com/d v1.0.0
+`
+	f, err := parseModFile([]byte(gomod))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &modFile{
+		module:    "example.com/m",
+		goVersion: "1.21",
+		require: []moduleVersion{
+			{"example.com/a", "v1.0.0"},
+			{"example.com/b", "v1.2.3"},
+			{"example.com/c", "v0.1.0"},
+		},
+		replace: []modReplace{
+			{moduleVersion{"example.com/a", ""}, moduleVersion{"../a", ""}},
+			{moduleVersion{"example.com/b", "v1.2.3"}, moduleVersion{"example.com/fork", "v1.2.4"}},
+		},
+	}
+	if !reflect.DeepEqual(f, want) {
+		t.Errorf("got %+v, want %+v", f, want)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	// In increasing order.
+	versions := []string{
+		"v0.0.0-20170915032832-14c0d48ead0c",
+		"v0.0.0-20180101000000-abcdef012345",
+		"v0.1.0",
+		"v1.0.0-alpha",
+		"v1.0.0-alpha.1",
+		"v1.0.0-alpha.beta",
+		"v1.0.0-beta.2",
+		"v1.0.0-beta.11",
+		"v1.0.0",
+		"v1.2.0",
+		"v1.10.0",
+		"v2.0.0+incompatible",
+	}
+	for i, v := range versions {
+		for j, w := range versions {
+			want := compareInts(i, j)
+			if got := compareVersions(v, w); got != want {
+				t.Errorf("compareVersions(%q, %q) = %d, want %d", v, w, got, want)
+			}
+		}
+	}
+}
+
+func TestModules(t *testing.T) {
+	dir, err := filepath.Abs("testdata/modules")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := PackContext(&build.Default)
+	ctx.GO111MODULE = ""
+	ctx.GOMODCACHE = filepath.Join(dir, "modcache")
+	imp := NewCache().Importer(&ctx, filepath.Join(dir, "main", "a", "a.go"), GCMode)
+
+	tests := []struct {
+		path  string
+		names []string // exported names, or the error
+	}{
+		{"example.com/main/b", []string{"B"}},
+		{"example.com/local", []string{"Local"}},
+		{"example.com/Upper/sub", []string{"Sub"}},
+		{"example.com/dep", []string{"New"}},
+
+		// Only required by dependencies, at two versions.
+		{"example.com/trans", []string{"T"}},
+
+		{"example.com/missing", []string{"module example.com/missing providing package example.com/missing is not in the module cache"}},
+		{"example.com/unknown", []string{"no required module provides package example.com/unknown"}},
+	}
+	for _, test := range tests {
+		var names []string
+		pkg, err := imp.ImportFrom(test.path, filepath.Join(dir, "main", "a"), 0)
+		if err != nil {
+			names = []string{strings.SplitN(err.Error(), " (", 2)[0]}
+		} else {
+			names = pkg.Scope().Names()
+		}
+		if !reflect.DeepEqual(names, test.names) {
+			t.Errorf("%s: got %v, want %v", test.path, names, test.names)
+		}
+	}
+
+	trans, err := imp.Import("example.com/trans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj := trans.Scope().Lookup("T"); obj == nil || !strings.Contains(obj.Type().Underlying().String(), "V12") {
+		t.Errorf("got example.com/trans.T %v, want version v1.2.0", obj)
+	}
+}
+
+func TestWorkspace(t *testing.T) {
+	dir, err := filepath.Abs("testdata/modules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "work", "app", "app.go")
+
+	tests := []struct {
+		gowork string
+		path   string
+		want   string // exported names or error
+	}{
+		// Workspace modules are used from source, and go.work
+		// replacements override the ones in go.mod.
+		{"", "example.com/lib", "[Unreleased]"},
+		{"", "example.com/trans", "T interface{Work()}"},
+
+		{"off", "example.com/lib", "module example.com/lib providing package example.com/lib is not in the module cache"},
+		{"off", "example.com/trans", "T interface{V11()}"},
+	}
+	for _, test := range tests {
+		ctx := PackContext(&build.Default)
+		ctx.GO111MODULE = ""
+		ctx.GOMODCACHE = filepath.Join(dir, "modcache")
+		ctx.GOWORK = test.gowork
+
+		var got string
+		pkg, err := NewCache().Importer(&ctx, filename, GCMode).Import(test.path)
+		switch {
+		case err != nil:
+			got = strings.SplitN(err.Error(), " (", 2)[0]
+		case pkg.Scope().Lookup("T") != nil:
+			got = "T " + pkg.Scope().Lookup("T").Type().Underlying().String()
+		default:
+			got = fmt.Sprint(pkg.Scope().Names())
+		}
+		if got != test.want {
+			t.Errorf("GOWORK=%q %s: got %s, want %s", test.gowork, test.path, got, test.want)
+		}
+	}
+}
+
+func TestGoListMode(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":           "module example.com/m\n\ngo 1.21\n",
+		"a/a.go":           "package a\n\nimport _ \"example.com/m/b\"\n",
+		"b/b.go":           "package b\n\nfunc B() {}\n",
+		"broken/broken.go": "package broken\n\nfunc Broken() { undefined() }\n",
+	}
+	write := func(name, src string) {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, src := range files {
+		write(name, src)
+	}
+
+	ctx := PackContext(&build.Default)
+	ctx.GO111MODULE = ""
+	if _, err := goListExports(&ctx, dir, "example.com/m/b", false, time.Time{}); err != nil {
+		t.Skip(err)
+	}
+	cache := NewCache()
+	check := func(path, want string, export bool) {
+		t.Helper()
+		imp := cache.Importer(&ctx, filepath.Join(dir, "a", "a.go"), GoListMode)
+		pkg, err := imp.Import(path)
+		if err != nil {
+			t.Fatalf("import %s: %v", path, err)
+		}
+		if got := fmt.Sprint(pkg.Scope().Names()); got != want {
+			t.Errorf("import %s: got %s, want %s", path, got, want)
+		}
+		if e := imp.part.pkgs[path]; e == nil || (e.obj != "") != export {
+			t.Errorf("import %s: loaded from export data = %v, want %v", path, e != nil && e.obj != "", export)
+		}
+	}
+
+	check("example.com/m/b", "[B]", true)
+
+	// Packages that don't compile have no export data.
+	check("example.com/m/broken", "[Broken]", false)
+
+	// Changes are picked up by listing the package again.
+	write("b/b.go", "package b\n\nfunc B2() {}\n")
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(dir, "b", "b.go"), future, future)
+	check("example.com/m/b", "[B2]", true)
+}
+
+func TestFindPackage(t *testing.T) {
+	dir, err := filepath.Abs("testdata/modules")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := PackContext(&build.Default)
+	ctx.GO111MODULE = ""
+	ctx.GOMODCACHE = filepath.Join(dir, "modcache")
+	srcDir := filepath.Join(dir, "main", "a")
+	imp := NewCache().Importer(&ctx, filepath.Join(srcDir, "a.go"), GCMode)
+
+	tests := []struct {
+		name, want string
+	}{
+		{"strings", "strings"},
+		{"template", "html/template"},
+		{"b", "example.com/main/b"},
+		{"dep", "example.com/dep"},
+		{"local", "example.com/local"},
+		{"sub", "example.com/Upper/sub"},
+
+		// Internal packages of the standard library are
+		// off-limits.
+		{"bytealg", ""},
+		{"unknown", ""},
+	}
+	for _, test := range tests {
+		if got := imp.FindPackage(test.name, srcDir); got != test.want {
+			t.Errorf("FindPackage(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
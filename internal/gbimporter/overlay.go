@@ -0,0 +1,106 @@
+package gbimporter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SetOverlay makes i read the files in overlay, keyed by absolute
+// filename, from there instead of from disk. Files in overlay that
+// don't exist on disk are added to their directories.
+//
+// Packages with overlaid files are always imported from source,
+// since their export data can't reflect the unsaved changes.
+func (i *Importer) SetOverlay(overlay map[string][]byte) {
+	i.overlay = overlay
+	if len(overlay) == 0 {
+		return
+	}
+	i.bctx.OpenFile = i.openFile
+	i.bctx.ReadDir = i.readDir
+}
+
+func (i *Importer) openFile(name string) (io.ReadCloser, error) {
+	if src, ok := i.overlay[name]; ok {
+		return ioutil.NopCloser(bytes.NewReader(src)), nil
+	}
+	return os.Open(name)
+}
+
+func (i *Importer) readDir(dir string) ([]os.FileInfo, error) {
+	fis, err := ioutil.ReadDir(dir)
+	names := i.overlaid(dir)
+	if err != nil && len(names) == 0 {
+		return nil, err
+	}
+
+	onDisk := make(map[string]bool)
+	for _, fi := range fis {
+		onDisk[fi.Name()] = true
+	}
+	for _, name := range names {
+		if base := filepath.Base(name); !onDisk[base] {
+			fis = append(fis, overlayFileInfo{base, int64(len(i.overlay[name]))})
+		}
+	}
+	sort.Slice(fis, func(a, b int) bool { return fis[a].Name() < fis[b].Name() })
+	return fis, nil
+}
+
+// source returns the contents of filename to pass to the parser:
+// the overlaid contents, or nil to read the file from disk.
+func (i *Importer) source(filename string) interface{} {
+	if src, ok := i.overlay[filename]; ok {
+		return src
+	}
+	return nil
+}
+
+// overlaid returns the overlaid Go files in dir, sorted.
+func (i *Importer) overlaid(dir string) []string {
+	var names []string
+	for name := range i.overlay {
+		if filepath.Dir(name) == dir && strings.HasSuffix(name, ".go") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// overlayKey returns a string identifying the overlaid contents of
+// the Go files in dir, or "" if there are none.
+func (i *Importer) overlayKey(dir string) string {
+	names := i.overlaid(dir)
+	if len(names) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	for _, name := range names {
+		src := i.overlay[name]
+		fmt.Fprintf(h, "%s\x00%d\x00", name, len(src))
+		h.Write(src)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// overlayFileInfo describes a file that only exists in an overlay.
+type overlayFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi overlayFileInfo) Name() string       { return fi.name }
+func (fi overlayFileInfo) Size() int64        { return fi.size }
+func (fi overlayFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi overlayFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi overlayFileInfo) IsDir() bool        { return false }
+func (fi overlayFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,323 @@
+package gbimporter
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A PackageDir is a directory holding a package that can be
+// imported.
+type PackageDir struct {
+	Path  string // import path
+	Dir   string
+	Std   bool // whether it's in the standard library
+	Depth int  // number of elements in Path
+}
+
+// indexRecheck is how long the package index is trusted before
+// checking whether the directories it was built from have changed.
+const indexRecheck = time.Second
+
+// A packageIndex holds the packages found in the source trees of a
+// partition, so that requests don't walk GOROOT and GOPATH each time
+// they look for a package.
+type packageIndex struct {
+	trees map[treeSpec]*packageTree
+
+	// docs caches the names and documentation of packages, keyed
+	// by directory.
+	docs map[string]*packageDoc
+}
+
+// A treeSpec describes a tree of packages. See packageTree.walk.
+type treeSpec struct {
+	root, prefix string
+	std, gopath  bool
+}
+
+type packageTree struct {
+	// done is closed once the tree has been walked into pkgs and
+	// dirs.
+	done chan struct{}
+	pkgs []indexedPackage
+
+	// dirs holds the modification time of each directory walked,
+	// which changes when packages are added or removed.
+	dirs map[string]time.Time
+
+	// checked is when the tree was last walked or found to be
+	// unchanged. It's guarded by indexMu.
+	checked time.Time
+}
+
+type indexedPackage struct {
+	PackageDir
+
+	// scope is the directory that importers must be in because of
+	// the internal and vendor directories in the package's path,
+	// or "" if there are none.
+	scope string
+}
+
+type packageDoc struct {
+	stamp     time.Time
+	name, doc string
+}
+
+// packageIndex returns p's package index. p.indexMu must be held.
+func (p *partition) packageIndex() *packageIndex {
+	if p.index == nil {
+		p.index = &packageIndex{
+			trees: make(map[treeSpec]*packageTree),
+			docs:  make(map[string]*packageDoc),
+		}
+	}
+	return p.index
+}
+
+// packageTree returns the packages in the tree described by spec,
+// walking it again if it has changed.
+//
+// The tree is walked and checked for changes without holding
+// p.indexMu. While one request checks a tree, others keep using it
+// as it is, and while one walks a tree, others wait for it rather
+// than walking it too.
+func (p *partition) packageTree(spec treeSpec) *packageTree {
+	p.indexMu.Lock()
+	index := p.packageIndex()
+	t := index.trees[spec]
+	if t != nil && time.Since(t.checked) < indexRecheck {
+		p.indexMu.Unlock()
+		<-t.done
+		return t
+	}
+	if t != nil {
+		t.checked = time.Now()
+	}
+	p.indexMu.Unlock()
+
+	if t != nil {
+		<-t.done
+		if !t.changed() {
+			return t
+		}
+	}
+
+	nt := &packageTree{
+		done:    make(chan struct{}),
+		checked: time.Now(),
+	}
+	p.indexMu.Lock()
+	if cur := index.trees[spec]; cur != t {
+		// Another request got there first.
+		p.indexMu.Unlock()
+		<-cur.done
+		return cur
+	}
+	index.trees[spec] = nt
+	p.indexMu.Unlock()
+
+	nt.walk(spec)
+	close(nt.done)
+	return nt
+}
+
+// changed reports whether any of the directories t was built from
+// has changed.
+func (t *packageTree) changed() bool {
+	for dir, stamp := range t.dirs {
+		if !fileStamp(dir).Equal(stamp) {
+			return true
+		}
+	}
+	return false
+}
+
+// Packages returns the packages that files in srcDir can import:
+// the standard library and, in a module, the packages of the modules
+// in the build list or vendor directory, or else the packages in
+// GOPATH and the vendor directories that apply to srcDir. Packages
+// in internal directories that srcDir can't use are left out.
+func (i *Importer) Packages(srcDir string) []PackageDir {
+	goroot := filepath.Join(i.ctx.GOROOT, "src")
+	specs := []treeSpec{{root: goroot, std: true}}
+	if i.mod != nil {
+		var paths []string
+		for path := range i.mod.deps {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			specs = append(specs, treeSpec{root: i.mod.deps[path], prefix: path})
+		}
+		if i.mod.vendor {
+			specs = append(specs, treeSpec{root: filepath.Join(i.mod.dir, "vendor")})
+		}
+	} else {
+		for _, src := range i.bctx.SrcDirs() {
+			if !samePath(src, goroot) {
+				specs = append(specs, treeSpec{root: src, gopath: true})
+			}
+		}
+	}
+
+	var pkgs []PackageDir
+	for _, spec := range specs {
+		for _, p := range i.part.packageTree(spec).pkgs {
+			if p.scope == "" || hasFilePathPrefix(srcDir, p.scope) {
+				pkgs = append(pkgs, p.PackageDir)
+			}
+		}
+	}
+	return pkgs
+}
+
+// walk fills in t with the packages in the tree rooted at
+// spec.root, whose import paths start with spec.prefix. If
+// spec.gopath is set, root is a GOPATH tree: its vendor directories
+// are walked too, and nested modules aren't skipped.
+func (t *packageTree) walk(spec treeSpec) {
+	t.dirs = make(map[string]time.Time)
+	var walk func(dir, importPath, scope string)
+	walk = func(dir, importPath, scope string) {
+		t.dirs[dir] = fileStamp(dir)
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return
+		}
+		hasGo := false
+		for _, fi := range fis {
+			name := fi.Name()
+			if !fi.IsDir() {
+				hasGo = hasGo || strings.HasSuffix(name, ".go") && !strings.HasSuffix(name, "_test.go")
+				continue
+			}
+			if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata" {
+				continue
+			}
+			sub := filepath.Join(dir, name)
+			switch {
+			case name == "vendor":
+				// Vendored packages keep their own import
+				// paths, but only for files within dir.
+				if spec.gopath {
+					walk(sub, "", dir)
+				}
+				continue
+			case name == "internal":
+				walk(sub, path.Join(importPath, name), dir)
+				continue
+			case spec.std && importPath == "" && name == "cmd":
+				continue
+			case !spec.gopath && isFile(filepath.Join(sub, "go.mod")):
+				// A nested module.
+				continue
+			}
+			walk(sub, path.Join(importPath, name), scope)
+		}
+		if hasGo && importPath != "" {
+			t.pkgs = append(t.pkgs, indexedPackage{
+				PackageDir: PackageDir{
+					Path:  importPath,
+					Dir:   dir,
+					Std:   spec.std,
+					Depth: strings.Count(importPath, "/") + 1,
+				},
+				scope: scope,
+			})
+		}
+	}
+	walk(spec.root, spec.prefix, "")
+}
+
+// PackageDoc returns the name and documentation of the package in
+// dir, or empty strings if no Go files there match the build
+// constraints. They're cached until the directory changes.
+func (i *Importer) PackageDoc(dir string) (name, doc string) {
+	stamp := dirStamp(dir)
+	i.part.indexMu.Lock()
+	d := i.part.packageIndex().docs[dir]
+	i.part.indexMu.Unlock()
+	if d != nil && d.stamp.Equal(stamp) {
+		return d.name, d.doc
+	}
+
+	// ImportDir always returns a package, but without a name if
+	// no Go files match the build constraints.
+	bp, _ := i.bctx.ImportDir(dir, 0)
+	d = &packageDoc{stamp: stamp, name: bp.Name, doc: bp.Doc}
+	i.part.indexMu.Lock()
+	i.part.packageIndex().docs[dir] = d
+	i.part.indexMu.Unlock()
+	return d.name, d.doc
+}
+
+// ImportPaths returns the import paths of the packages that files
+// in srcDir can import, mapped to their directories. Where vendored
+// packages shadow others, the innermost vendor directory wins, as it
+// does when importing them.
+func (i *Importer) ImportPaths(srcDir string) map[string]string {
+	paths := make(map[string]string)
+	for _, p := range i.Packages(srcDir) {
+		if dir, ok := paths[p.Path]; ok && vendorDepth(dir, p.Path) >= vendorDepth(p.Dir, p.Path) {
+			continue
+		}
+		paths[p.Path] = p.Dir
+	}
+	return paths
+}
+
+// vendorDepth returns the length of the vendor directory that dir,
+// the directory of importPath, is in, or 0 if it isn't vendored.
+func vendorDepth(dir, importPath string) int {
+	root := strings.TrimSuffix(filepath.ToSlash(dir), "/"+importPath)
+	if root == filepath.ToSlash(dir) || path.Base(root) != "vendor" {
+		return 0
+	}
+	return len(root)
+}
+
+// FindPackage returns the import path of a package named name that
+// files in srcDir can import, or "" if there isn't one. It prefers
+// the standard library, then shorter import paths.
+func (i *Importer) FindPackage(name, srcDir string) string {
+	var found []PackageDir
+	for _, p := range i.Packages(srcDir) {
+		if !strings.Contains(path.Base(p.Path), name) {
+			// Package names normally appear in the last
+			// element of their import paths, except for
+			// major versions, which have their own.
+			if !isMajorVersion(path.Base(p.Path)) || !strings.Contains(path.Base(path.Dir(p.Path)), name) {
+				continue
+			}
+		}
+		found = append(found, p)
+	}
+	sort.Slice(found, func(a, b int) bool {
+		x, y := found[a], found[b]
+		if x.Std != y.Std {
+			return x.Std
+		}
+		if x.Depth != y.Depth {
+			return x.Depth < y.Depth
+		}
+		return x.Path < y.Path
+	})
+
+	for _, p := range found {
+		if pkgName, _ := i.PackageDoc(p.Dir); pkgName == name {
+			return p.Path
+		}
+	}
+	return ""
+}
+
+// isMajorVersion reports whether elem is a major version suffix like
+// "v2".
+func isMajorVersion(elem string) bool {
+	return len(elem) >= 2 && elem[0] == 'v' && strings.Trim(elem[1:], "0123456789") == ""
+}
@@ -0,0 +1,3 @@
+package v
+
+func GOPATH() {}
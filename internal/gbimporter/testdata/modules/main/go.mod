@@ -0,0 +1,12 @@
+module example.com/main
+
+go 1.16
+
+require (
+	example.com/Upper v1.0.0
+	example.com/dep v1.1.0 // indirect
+	example.com/local v0.0.0
+	example.com/missing v1.0.0
+)
+
+replace example.com/local => ../local
@@ -0,0 +1,6 @@
+module example.com/Upper
+
+require (
+	example.com/trans v1.1.0
+	example.com/dep v1.0.0
+)
@@ -0,0 +1,3 @@
+module example.com/dep
+
+require example.com/trans v1.2.0
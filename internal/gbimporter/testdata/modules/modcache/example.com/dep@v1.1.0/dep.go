@@ -0,0 +1,5 @@
+package dep
+
+import "example.com/trans"
+
+func New() trans.T { return nil }
@@ -0,0 +1,10 @@
+module example.com/app
+
+go 1.21
+
+require (
+	example.com/lib v1.0.0
+	example.com/trans v1.1.0
+)
+
+replace example.com/trans => ../../modcache/example.com/trans@v1.1.0
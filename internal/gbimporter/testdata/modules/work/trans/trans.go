@@ -0,0 +1,3 @@
+package trans
+
+type T interface{ Work() }
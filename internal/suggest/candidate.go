@@ -12,6 +12,23 @@ type Candidate struct {
 	PkgPath string `json:"package"`
 	Name    string `json:"name"`
 	Type    string `json:"type"`
+
+	// Score ranks the candidate; candidates are listed highest
+	// score first. It's raised by fuzzy matches and by fitting
+	// the type expected at the cursor.
+	Score int `json:"score,omitempty"`
+
+	// Matched holds the ranges of Name matched by the partial
+	// identifier before the cursor, with fuzzy matching.
+	Matched []Range `json:"matched,omitempty"`
+
+	// Edits are other changes to the file that go with the
+	// candidate, like importing its package.
+	Edits []Edit `json:"edits,omitempty"`
+
+	// Doc is the synopsis of the package documentation, for
+	// import path candidates.
+	Doc string `json:"doc,omitempty"`
 }
 
 func (c Candidate) Suggestion() string {
@@ -29,15 +46,23 @@ func (c Candidate) String() string {
 	if c.Class == "func" {
 		return fmt.Sprintf("%s %s%s", c.Class, c.Name, strings.TrimPrefix(c.Type, "func"))
 	}
+	if c.Type == "" {
+		return fmt.Sprintf("%s %s", c.Class, c.Name)
+	}
 	return fmt.Sprintf("%s %s %s", c.Class, c.Name, c.Type)
 }
 
-type candidatesByClassAndName []Candidate
+// candidatesByScore orders candidates by descending score, then by
+// class and name.
+type candidatesByScore []Candidate
 
-func (s candidatesByClassAndName) Len() int      { return len(s) }
-func (s candidatesByClassAndName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s candidatesByScore) Len() int      { return len(s) }
+func (s candidatesByScore) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
 
-func (s candidatesByClassAndName) Less(i, j int) bool {
+func (s candidatesByScore) Less(i, j int) bool {
+	if s[i].Score != s[j].Score {
+		return s[i].Score > s[j].Score
+	}
 	if s[i].Class != s[j].Class {
 		return s[i].Class < s[j].Class
 	}
@@ -46,6 +71,8 @@ func (s candidatesByClassAndName) Less(i, j int) bool {
 
 type objectFilter func(types.Object) bool
 
+// objectFilters select the members of a class after a selector that
+// names it, like "fmt.func". Elsewhere these are keywords.
 var objectFilters = map[string]objectFilter{
 	"const":   func(obj types.Object) bool { _, ok := obj.(*types.Const); return ok },
 	"func":    func(obj types.Object) bool { _, ok := obj.(*types.Func); return ok },
@@ -77,23 +104,44 @@ func classifyObject(obj types.Object) string {
 type candidateCollector struct {
 	exact      []types.Object
 	badcase    []types.Object
+	fuzzy      []fuzzyObject
+	keywords   []Candidate
 	localpkg   *types.Package
 	partial    string
 	filter     objectFilter
 	builtin    bool
+	useFuzzy   bool
+	expected   types.Type
 }
 
-func (b *candidateCollector) getCandidates() []Candidate {
-	objs := b.exact
-	if objs == nil {
-		objs = b.badcase
-	}
+// A fuzzyObject is an object whose name fuzzily matches the partial
+// identifier.
+type fuzzyObject struct {
+	obj    types.Object
+	score  int
+	ranges []Range
+}
 
+func (b *candidateCollector) getCandidates() []Candidate {
 	var res []Candidate
-	for _, obj := range objs {
-		res = append(res, b.asCandidate(obj))
+	if b.useFuzzy && b.filter == nil {
+		for _, m := range b.fuzzy {
+			c := b.asCandidate(m.obj)
+			c.Matched = m.ranges
+			c.Score += m.score
+			res = append(res, c)
+		}
+	} else {
+		objs := b.exact
+		if objs == nil && b.keywords == nil {
+			objs = b.badcase
+		}
+		for _, obj := range objs {
+			res = append(res, b.asCandidate(obj))
+		}
 	}
-	sort.Sort(candidatesByClassAndName(res))
+	res = append(res, b.keywords...)
+	sort.Sort(candidatesByScore(res))
 	return res
 }
 
@@ -131,6 +179,7 @@ func (b *candidateCollector) asCandidate(obj types.Object) Candidate {
 		PkgPath: path,
 		Name:    obj.Name(),
 		Type:    typStr,
+		Score:   typeScore(obj, b.expected),
 	}
 }
 
@@ -171,7 +220,8 @@ func (b *candidateCollector) appendObject(obj types.Object) {
 			if !b.builtin {
 				return
 			}
-		} else if !obj.Exported() {
+		} else if !obj.Exported() && obj.Pkg().Path() != "C" {
+			// Everything cgo declares is accessible.
 			return
 		}
 	}
@@ -181,9 +231,33 @@ func (b *candidateCollector) appendObject(obj types.Object) {
 		return
 	}
 
+	if b.useFuzzy && b.filter == nil {
+		if score, ranges, ok := fuzzyMatch(b.partial, obj.Name()); ok {
+			b.fuzzy = append(b.fuzzy, fuzzyObject{obj, score, ranges})
+		}
+		return
+	}
+
 	if b.filter != nil || strings.HasPrefix(obj.Name(), b.partial) {
 		b.exact = append(b.exact, obj)
 	} else if strings.HasPrefix(strings.ToLower(obj.Name()), strings.ToLower(b.partial)) {
 		b.badcase = append(b.badcase, obj)
 	}
 }
+
+// appendKeyword adds kw as a candidate, if it matches the partial
+// identifier. Keywords are all lower case, so they must match it
+// exactly.
+func (b *candidateCollector) appendKeyword(kw string) {
+	c := Candidate{Class: "keyword", Name: kw}
+	if b.useFuzzy {
+		score, ranges, ok := fuzzyMatch(b.partial, kw)
+		if !ok {
+			return
+		}
+		c.Score, c.Matched = score, ranges
+	} else if !strings.HasPrefix(kw, b.partial) {
+		return
+	}
+	b.keywords = append(b.keywords, c)
+}
@@ -0,0 +1,889 @@
+package suggest
+
+import (
+	"go/ast"
+	"go/build"
+	"go/constant"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"regexp"
+	"strings"
+)
+
+// A cgoImporter imports cgo's "C" pseudo-package, synthesized from
+// the preambles of the files that import it, and leaves other imports
+// to imp.
+type cgoImporter struct {
+	imp types.ImporterFrom
+	pkg *types.Package
+}
+
+func (ci *cgoImporter) Import(path string) (*types.Package, error) {
+	return ci.ImportFrom(path, "", 0)
+}
+
+func (ci *cgoImporter) ImportFrom(path, srcDir string, mode types.ImportMode) (*types.Package, error) {
+	if path == "C" {
+		return ci.pkg, nil
+	}
+	return ci.imp.ImportFrom(path, srcDir, mode)
+}
+
+// withCgo returns imp, extended to import "C" if any of the files of
+// package local use cgo. readFile returns the contents the files
+// were parsed from, and bctx describes the target.
+func withCgo(imp types.ImporterFrom, local *types.Package, fset *token.FileSet, files []*ast.File, readFile func(string) ([]byte, error), bctx *build.Context) types.ImporterFrom {
+	var preambles []string
+	cgo := false
+	for _, file := range files {
+		preamble, ok := cgoPreamble(fset, file, readFile)
+		if ok {
+			cgo = true
+			preambles = append(preambles, preamble)
+		}
+	}
+	if !cgo {
+		return imp
+	}
+	return &cgoImporter{
+		imp: imp,
+		pkg: newCgoPackage(local, strings.Join(preambles, "\n"), bctx),
+	}
+}
+
+// cgoPreamble returns the preamble of file, the comment just before
+// its import of "C", and reports whether file imports "C" at all.
+func cgoPreamble(fset *token.FileSet, file *ast.File, readFile func(string) ([]byte, error)) (string, bool) {
+	cgo := false
+	for _, spec := range file.Imports {
+		if spec.Path.Value == `"C"` {
+			cgo = true
+		}
+	}
+	if !cgo {
+		return "", false
+	}
+
+	// Comments are usually not kept, so parse the imports again.
+	filename := fset.File(file.Pos()).Name()
+	src, err := readFile(filename)
+	if err != nil {
+		return "", true
+	}
+	f, _ := parser.ParseFile(token.NewFileSet(), filename, src, parser.ImportsOnly|parser.ParseComments)
+	if f == nil {
+		return "", true
+	}
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.IMPORT {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			spec := spec.(*ast.ImportSpec)
+			if spec.Path.Value != `"C"` {
+				continue
+			}
+			doc := spec.Doc
+			if doc == nil && !gd.Lparen.IsValid() {
+				doc = gd.Doc
+			}
+			if doc != nil {
+				return doc.Text(), true
+			}
+		}
+	}
+	return "", true
+}
+
+// cgoTypes maps the names of the C types that cgo always provides to
+// their Go representation.
+var cgoTypes = map[string]types.BasicKind{
+	"char":      types.Int8,
+	"schar":     types.Int8,
+	"uchar":     types.Uint8,
+	"short":     types.Int16,
+	"ushort":    types.Uint16,
+	"int":       types.Int32,
+	"uint":      types.Uint32,
+	"long":      types.Int64,
+	"ulong":     types.Uint64,
+	"longlong":  types.Int64,
+	"ulonglong": types.Uint64,
+	"float":     types.Float32,
+	"double":    types.Float64,
+	"size_t":    types.Uint64,
+}
+
+// cgoHeaderTypes maps the names of common types from standard C
+// headers to their Go representation. They're only declared if the
+// preamble uses them.
+var cgoHeaderTypes = map[string]types.BasicKind{
+	"_Bool":     types.Bool,
+	"bool":      types.Bool,
+	"int8_t":    types.Int8,
+	"int16_t":   types.Int16,
+	"int32_t":   types.Int32,
+	"int64_t":   types.Int64,
+	"uint8_t":   types.Uint8,
+	"uint16_t":  types.Uint16,
+	"uint32_t":  types.Uint32,
+	"uint64_t":  types.Uint64,
+	"intptr_t":  types.Int64,
+	"uintptr_t": types.Uint64,
+	"ssize_t":   types.Int64,
+	"off_t":     types.Int64,
+}
+
+// cgoWordTypes holds the types of cgoTypes and cgoHeaderTypes that
+// are as big as a pointer, rather than the 64 bits listed there. Those
+// mapped to true are 32 bits on Windows even so.
+var cgoWordTypes = map[string]bool{
+	"long":      true,
+	"ulong":     true,
+	"intptr_t":  false,
+	"uintptr_t": false,
+	"size_t":    false,
+	"ssize_t":   false,
+}
+
+// A cgoParser declares the contents of a cgo preamble in a "C"
+// package. It understands just enough C to find the functions,
+// variables, types and constants a preamble declares, and skips
+// anything else.
+type cgoParser struct {
+	pkg   *types.Package
+	local *types.Package // for struct fields, like cgo's generated code
+
+	// wordSize is the size of a pointer on the target, and
+	// windows is set if it's Windows, where long is 32 bits.
+	wordSize int64
+	windows  bool
+
+	// typedefs records the types declared by typedef as aliases
+	// of a named type, whose underlying type may not be known until
+	// the whole preamble has been read.
+	typedefs   []cgoTypedef
+	incomplete []*types.Named
+
+	toks []string
+	pos  int
+}
+
+type cgoTypedef struct {
+	named, target *types.Named
+}
+
+// cgoVoid stands for C's void type while parsing.
+var cgoVoid types.Type = types.NewTuple()
+
+var cgoByte = types.Universe.Lookup("byte").Type()
+
+// newCgoPackage returns a "C" package with the declarations in
+// preamble, along with the types and functions cgo always provides.
+// Without a C compiler, only #define constants with Go-compatible
+// values are declared, and types from #included headers are unknown
+// unless they're common standard C types. The sizes of C types are
+// those of the target described by bctx.
+func newCgoPackage(local *types.Package, preamble string, bctx *build.Context) *types.Package {
+	p := &cgoParser{
+		pkg:      types.NewPackage("C", "C"),
+		local:    local,
+		wordSize: 8,
+		windows:  bctx.GOOS == "windows",
+	}
+	if sizes := types.SizesFor("gc", bctx.GOARCH); sizes != nil {
+		p.wordSize = sizes.Sizeof(types.Typ[types.Uintptr])
+	}
+	for name := range cgoTypes {
+		p.typeName(name)
+	}
+	p.declareHelpers()
+
+	var code []string
+	for _, line := range strings.Split(stripCComments(preamble), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			p.directive(strings.TrimSpace(line[1:]))
+		} else {
+			code = append(code, line)
+		}
+	}
+
+	p.toks = cTokens(strings.Join(code, "\n"))
+	for p.pos < len(p.toks) {
+		p.declaration()
+	}
+
+	for _, named := range p.incomplete {
+		if named.Underlying() == nil || named.Underlying() == types.Typ[types.Invalid] {
+			named.SetUnderlying(types.NewStruct(nil, nil))
+		}
+	}
+	for _, td := range p.typedefs {
+		td.named.SetUnderlying(td.target.Underlying())
+	}
+
+	p.pkg.MarkComplete()
+	return p.pkg
+}
+
+// declareHelpers declares the functions that cgo provides for
+// converting between Go and C values.
+func (p *cgoParser) declareHelpers() {
+	charp := types.NewPointer(p.typeName("char"))
+	cint := p.typeName("int")
+	ptr := types.Typ[types.UnsafePointer]
+	bytes := types.NewSlice(cgoByte)
+	str := types.Typ[types.String]
+
+	p.declareFunc("CString", []types.Type{str}, charp)
+	p.declareFunc("CBytes", []types.Type{bytes}, ptr)
+	p.declareFunc("GoString", []types.Type{charp}, str)
+	p.declareFunc("GoStringN", []types.Type{charp, cint}, str)
+	p.declareFunc("GoBytes", []types.Type{ptr, cint}, bytes)
+}
+
+func (p *cgoParser) declareFunc(name string, params []types.Type, result types.Type) {
+	var vars []*types.Var
+	for _, typ := range params {
+		vars = append(vars, types.NewParam(token.NoPos, p.pkg, "", typ))
+	}
+	res := types.NewTuple(types.NewParam(token.NoPos, p.pkg, "", result))
+	sig := types.NewSignatureType(nil, nil, nil, types.NewTuple(vars...), res, false)
+	p.pkg.Scope().Insert(types.NewFunc(token.NoPos, p.pkg, name, sig))
+}
+
+// typeName returns the C type with the given cgo name, such as "int"
+// or "struct_point", declaring it if necessary. It returns nil if
+// there's no such type.
+func (p *cgoParser) typeName(name string) *types.Named {
+	if obj, ok := p.pkg.Scope().Lookup(name).(*types.TypeName); ok {
+		return obj.Type().(*types.Named)
+	}
+
+	var underlying types.Type
+	if kind, ok := p.basicKind(name); ok {
+		underlying = types.Typ[kind]
+	} else if !strings.HasPrefix(name, "struct_") && !strings.HasPrefix(name, "union_") && !strings.HasPrefix(name, "enum_") {
+		return nil
+	}
+
+	obj := types.NewTypeName(token.NoPos, p.pkg, name, nil)
+	named := types.NewNamed(obj, underlying, nil)
+	if underlying == nil {
+		p.incomplete = append(p.incomplete, named)
+	}
+	p.pkg.Scope().Insert(obj)
+	return named
+}
+
+// basicKind returns the Go representation of the C type with the
+// given cgo name, if it's one of cgoTypes or cgoHeaderTypes, sized for
+// the target.
+func (p *cgoParser) basicKind(name string) (types.BasicKind, bool) {
+	kind, ok := cgoTypes[name]
+	if !ok {
+		kind, ok = cgoHeaderTypes[name]
+	}
+	if long, word := cgoWordTypes[name]; ok && word && (p.wordSize == 4 || long && p.windows) {
+		switch kind {
+		case types.Int64:
+			kind = types.Int32
+		case types.Uint64:
+			kind = types.Uint32
+		}
+	}
+	return kind, ok
+}
+
+var (
+	cIntSuffix   = regexp.MustCompile(`^((?:0[xX][0-9a-fA-F]+)|[0-9]+)[uUlL]+$`)
+	cFloatSuffix = regexp.MustCompile(`^([0-9]*\.?[0-9]+(?:[eE][-+]?[0-9]+)?)[fFlL]$`)
+)
+
+// directive handles a preprocessor directive, without the leading
+// '#'. Only object-like macros that expand to constants are
+// declared.
+func (p *cgoParser) directive(line string) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[0] != "define" || strings.Contains(fields[1], "(") {
+		return
+	}
+	name := fields[1]
+	if val := p.constExpr(cTokens(strings.Join(fields[2:], " "))); val != nil {
+		p.declareConst(name, val)
+	}
+}
+
+// constExpr evaluates the C constant expression toks, returning nil
+// if it can't be understood as a Go constant expression.
+func (p *cgoParser) constExpr(toks []string) *types.TypeAndValue {
+	if len(toks) == 0 {
+		return nil
+	}
+	var expr []string
+	for _, tok := range toks {
+		if m := cIntSuffix.FindStringSubmatch(tok); m != nil {
+			tok = m[1]
+		} else if m := cFloatSuffix.FindStringSubmatch(tok); m != nil {
+			tok = m[1]
+		}
+		expr = append(expr, tok)
+	}
+	tv, err := types.Eval(token.NewFileSet(), p.pkg, token.NoPos, strings.Join(expr, " "))
+	if err != nil || tv.Value == nil {
+		return nil
+	}
+	return &tv
+}
+
+func (p *cgoParser) declareConst(name string, tv *types.TypeAndValue) {
+	p.pkg.Scope().Insert(types.NewConst(token.NoPos, p.pkg, name, tv.Type, tv.Value))
+}
+
+func (p *cgoParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *cgoParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *cgoParser) accept(tok string) bool {
+	if p.peek() == tok {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// skipTo skips tokens up to, but not including, the first of stops
+// outside of brackets.
+func (p *cgoParser) skipTo(stops ...string) {
+	depth := 0
+	for p.pos < len(p.toks) {
+		tok := p.peek()
+		if depth == 0 {
+			for _, stop := range stops {
+				if tok == stop {
+					return
+				}
+			}
+		}
+		switch tok {
+		case "(", "[", "{":
+			depth++
+		case ")", "]", "}":
+			if depth == 0 {
+				return
+			}
+			depth--
+		}
+		p.pos++
+	}
+}
+
+// progress returns a function that skips a token if none was
+// consumed since progress was called, so that parsing never gets
+// stuck on unexpected input.
+func (p *cgoParser) progress() func() {
+	start := p.pos
+	return func() {
+		if p.pos == start {
+			p.pos++
+		}
+	}
+}
+
+// skipGroup skips a bracketed group starting at the current token.
+func (p *cgoParser) skipGroup() {
+	p.next()
+	p.skipTo()
+	p.next()
+}
+
+// declaration parses a top-level declaration or function definition.
+func (p *cgoParser) declaration() {
+	defer p.progress()()
+
+	base, typedef, ok := p.specifiers()
+	if !ok {
+		p.skipTo(";", "{")
+		if p.peek() == "{" {
+			p.skipGroup()
+		}
+		p.accept(";")
+		return
+	}
+	for !p.accept(";") {
+		name, typ, ok := p.declarator(base)
+		if ok && name != "" {
+			p.declare(name, typ, typedef)
+		}
+		if _, isFunc := typ.(*types.Signature); isFunc && p.peek() == "{" {
+			p.skipGroup()
+			return
+		}
+		p.skipTo(",", ";")
+		if !p.accept(",") && p.peek() != ";" {
+			return
+		}
+	}
+}
+
+// declare declares name, a variable, function or typedef of type typ.
+func (p *cgoParser) declare(name string, typ types.Type, typedef bool) {
+	scope := p.pkg.Scope()
+	switch {
+	case typ == cgoVoid:
+	case typedef:
+		if scope.Lookup(name) != nil {
+			return
+		}
+		obj := types.NewTypeName(token.NoPos, p.pkg, name, nil)
+		named := types.NewNamed(obj, nil, nil)
+		if target, ok := typ.(*types.Named); ok {
+			p.typedefs = append(p.typedefs, cgoTypedef{named, target})
+		} else {
+			named.SetUnderlying(typ)
+		}
+		scope.Insert(obj)
+	default:
+		if sig, ok := typ.(*types.Signature); ok {
+			scope.Insert(types.NewFunc(token.NoPos, p.pkg, name, sig))
+		} else {
+			scope.Insert(types.NewVar(token.NoPos, p.pkg, name, typ))
+		}
+	}
+}
+
+// specifiers parses declaration specifiers, such as "static unsigned
+// int" or "struct point", and returns the type they denote and
+// whether they include typedef. It fails if the type is unknown.
+func (p *cgoParser) specifiers() (typ types.Type, typedef, ok bool) {
+	var words []string
+	for {
+		tok := p.peek()
+		switch tok {
+		case "typedef":
+			typedef = true
+		case "static", "extern", "inline", "__inline", "__inline__", "const", "volatile", "register", "restrict", "__restrict", "__extension__", "_Noreturn":
+		case "__attribute__", "__declspec":
+			p.next()
+			if p.peek() == "(" {
+				p.skipGroup()
+			}
+			continue
+		case "signed", "unsigned", "short", "long", "int", "char", "float", "double", "void":
+			words = append(words, tok)
+			typ = nil
+		case "struct", "union":
+			typ = p.record()
+			continue
+		case "enum":
+			typ = p.enum()
+			continue
+		default:
+			if typ != nil || len(words) > 0 || !isCIdent(tok) {
+				switch name := cBasicType(words); {
+				case len(words) == 0:
+				case name == "void":
+					typ = cgoVoid
+				default:
+					typ = p.typeName(name)
+				}
+				return typ, typedef, typ != nil
+			}
+			named, ok := p.pkg.Scope().Lookup(tok).(*types.TypeName)
+			if !ok {
+				if t := p.typeName(tok); t != nil {
+					typ = t
+				} else {
+					return nil, typedef, false
+				}
+			} else {
+				typ = named.Type()
+			}
+		}
+		p.next()
+	}
+}
+
+// cBasicType returns the cgo name of the C type specified by words,
+// such as "ulong" for "unsigned long int", or "void".
+func cBasicType(words []string) string {
+	var signed, unsigned, char, float, double, void bool
+	short, long := 0, 0
+	for _, w := range words {
+		switch w {
+		case "signed":
+			signed = true
+		case "unsigned":
+			unsigned = true
+		case "short":
+			short++
+		case "long":
+			long++
+		case "char":
+			char = true
+		case "float":
+			float = true
+		case "double":
+			double = true
+		case "void":
+			void = true
+		}
+	}
+
+	var name string
+	switch {
+	case void:
+		return "void"
+	case char && unsigned:
+		name = "uchar"
+	case char && signed:
+		name = "schar"
+	case char:
+		name = "char"
+	case float:
+		name = "float"
+	case double:
+		name = "double"
+	case short > 0:
+		name = "short"
+	case long == 1:
+		name = "long"
+	case long > 1:
+		name = "longlong"
+	default:
+		name = "int"
+	}
+	if unsigned && !char {
+		name = "u" + name
+	}
+	return name
+}
+
+// record parses a struct or union specifier.
+func (p *cgoParser) record() types.Type {
+	kind := p.next()
+	var named *types.Named
+	if isCIdent(p.peek()) {
+		named = p.typeName(kind + "_" + p.next())
+	}
+	if p.peek() != "{" {
+		if named == nil {
+			return nil
+		}
+		return named
+	}
+
+	var typ types.Type
+	if kind == "union" {
+		// cgo represents unions as byte arrays.
+		p.skipGroup()
+		typ = types.NewArray(cgoByte, 0)
+	} else {
+		typ = p.fields()
+	}
+	if named == nil {
+		return typ
+	}
+	named.SetUnderlying(typ)
+	return named
+}
+
+// fields parses the body of a struct.
+func (p *cgoParser) fields() *types.Struct {
+	p.next()
+	var fields []*types.Var
+	for p.peek() != "}" && p.peek() != "" {
+		done := p.progress()
+		base, _, ok := p.specifiers()
+		for ok && p.peek() != ";" {
+			name, typ, ok := p.declarator(base)
+			if ok && name != "" && typ != cgoVoid && p.peek() != ":" {
+				// Like cgo, avoid Go keywords.
+				if token.Lookup(name).IsKeyword() {
+					name = "_" + name
+				}
+				fields = append(fields, types.NewField(token.NoPos, p.local, name, typ, false))
+			}
+			p.skipTo(",", ";")
+			if !p.accept(",") {
+				break
+			}
+		}
+		p.skipTo(";")
+		p.accept(";")
+		done()
+	}
+	p.accept("}")
+	return types.NewStruct(fields, nil)
+}
+
+// enum parses an enum specifier and declares its constants.
+func (p *cgoParser) enum() types.Type {
+	p.next()
+	var named *types.Named
+	if isCIdent(p.peek()) {
+		named = p.typeName("enum_" + p.next())
+	}
+	if !p.accept("{") {
+		if named == nil {
+			return nil
+		}
+		return named
+	}
+
+	next := &types.TypeAndValue{Type: types.Typ[types.UntypedInt], Value: constant.MakeInt64(0)}
+	var prev string
+	for !p.accept("}") && p.peek() != "" {
+		name := p.next()
+		tv := next
+		if p.accept("=") {
+			start := p.pos
+			p.skipTo(",", "}")
+			tv = p.constExpr(p.toks[start:p.pos])
+		} else if prev != "" {
+			tv = p.constExpr([]string{prev, "+", "1"})
+		}
+		if isCIdent(name) && tv != nil {
+			p.declareConst(name, tv)
+			prev = name
+		} else {
+			prev = ""
+		}
+		next = nil
+		p.accept(",")
+	}
+
+	typ := types.Typ[types.Uint32]
+	if named == nil {
+		return typ
+	}
+	named.SetUnderlying(typ)
+	return named
+}
+
+// declarator parses a declarator of a value of type base and returns
+// the declared name, which may be empty, and its type.
+func (p *cgoParser) declarator(base types.Type) (name string, typ types.Type, ok bool) {
+	typ = base
+	for p.accept("*") {
+		switch typ {
+		case cgoVoid:
+			typ = types.Typ[types.UnsafePointer]
+		default:
+			typ = types.NewPointer(typ)
+		}
+		for p.accept("const") || p.accept("volatile") || p.accept("restrict") || p.accept("__restrict") {
+		}
+	}
+
+	// Function pointers, which cgo represents as *[0]byte.
+	if p.peek() == "(" && p.pos+1 < len(p.toks) && p.toks[p.pos+1] == "*" {
+		p.next()
+		p.next()
+		if isCIdent(p.peek()) {
+			name = p.next()
+		}
+		p.skipTo(")")
+		p.accept(")")
+		for p.peek() == "(" || p.peek() == "[" {
+			p.skipGroup()
+		}
+		return name, types.NewPointer(types.NewArray(cgoByte, 0)), true
+	}
+
+	if isCIdent(p.peek()) {
+		name = p.next()
+	}
+
+	switch p.peek() {
+	case "(":
+		sig, ok := p.params(typ)
+		return name, sig, ok
+	case "[":
+		var dims []int64
+		for p.accept("[") {
+			start := p.pos
+			p.skipTo("]")
+			n := int64(0)
+			if tv := p.constExpr(p.toks[start:p.pos]); tv != nil {
+				if v, exact := constant.Int64Val(constant.ToInt(tv.Value)); exact {
+					n = v
+				}
+			}
+			p.accept("]")
+			dims = append(dims, n)
+		}
+		if typ == cgoVoid {
+			return name, typ, false
+		}
+		for i := len(dims) - 1; i >= 0; i-- {
+			typ = types.NewArray(typ, dims[i])
+		}
+	}
+	return name, typ, typ != nil
+}
+
+// params parses the parameter list of a function returning result.
+func (p *cgoParser) params(result types.Type) (*types.Signature, bool) {
+	p.next()
+	var params []*types.Var
+	ok := true
+	if p.peek() == "void" && p.pos+1 < len(p.toks) && p.toks[p.pos+1] == ")" {
+		p.next()
+	}
+	for p.peek() != ")" && p.peek() != "" {
+		done := p.progress()
+		if p.accept("...") {
+			// cgo can't call variadic C functions.
+			ok = false
+			break
+		}
+		base, _, baseOK := p.specifiers()
+		name, typ, declOK := p.declarator(base)
+		if !baseOK || !declOK || typ == cgoVoid {
+			ok = false
+		}
+		if arr, isArray := typ.(*types.Array); isArray {
+			typ = types.NewPointer(arr.Elem())
+		}
+		if token.Lookup(name).IsKeyword() {
+			name = "_" + name
+		}
+		params = append(params, types.NewParam(token.NoPos, p.pkg, name, typ))
+		p.skipTo(",", ")")
+		p.accept(",")
+		done()
+	}
+	p.skipTo(")")
+	p.accept(")")
+	for p.peek() == "__attribute__" || p.peek() == "__asm__" || p.peek() == "asm" {
+		p.next()
+		if p.peek() == "(" {
+			p.skipGroup()
+		}
+	}
+
+	var results *types.Tuple
+	if result == nil {
+		ok = false
+	} else if result != cgoVoid {
+		results = types.NewTuple(types.NewParam(token.NoPos, p.pkg, "", result))
+	}
+	return types.NewSignatureType(nil, nil, nil, types.NewTuple(params...), results, false), ok
+}
+
+func isCIdent(tok string) bool {
+	if tok == "" || isDigit(tok[0]) {
+		return false
+	}
+	for i := 0; i < len(tok); i++ {
+		if !isIdentByte(tok[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// stripCComments replaces the comments in C source with spaces, so
+// that line structure is kept.
+func stripCComments(src string) string {
+	var b strings.Builder
+	for i := 0; i < len(src); i++ {
+		switch {
+		case src[i] == '"' || src[i] == '\'':
+			quote := src[i]
+			j := i + 1
+			for j < len(src) && src[j] != quote && src[j] != '\n' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				j = len(src) - 1
+			}
+			b.WriteString(src[i : j+1])
+			i = j
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			b.WriteByte('\n')
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				end = len(src) - i - 2
+			}
+			b.WriteString(strings.Repeat("\n", strings.Count(src[i:i+2+end], "\n")))
+			b.WriteByte(' ')
+			i += end + 3
+		default:
+			b.WriteByte(src[i])
+		}
+	}
+	return strings.Replace(b.String(), "\\\n", " ", -1)
+}
+
+// cTokens splits C source into tokens.
+func cTokens(src string) []string {
+	var toks []string
+	for i := 0; i < len(src); {
+		c := src[i]
+		j := i + 1
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			i++
+			continue
+		case isIdentByte(c) || c == '.' && j < len(src) && isDigit(src[j]):
+			number := isDigit(c) || c == '.'
+			for j < len(src) {
+				d := src[j]
+				exp := src[j-1] == 'e' || src[j-1] == 'E'
+				if !isIdentByte(d) && !(number && (d == '.' || exp && (d == '+' || d == '-'))) {
+					break
+				}
+				j++
+			}
+		case c == '"' || c == '\'':
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j < len(src) {
+				j++
+			}
+		case strings.HasPrefix(src[i:], "..."):
+			j = i + 3
+		case strings.HasPrefix(src[i:], "<<") || strings.HasPrefix(src[i:], ">>"):
+			j = i + 2
+		}
+		if j > len(src) {
+			j = len(src)
+		}
+		toks = append(toks, src[i:j])
+		i = j
+	}
+	return toks
+}
@@ -0,0 +1,55 @@
+package suggest
+
+import (
+	"fmt"
+	"go/types"
+)
+
+// Kinds of Error.
+const (
+	PanicError  = "panic"  // gocode itself crashed
+	ParseError  = "parse"  // the file could not be parsed well enough to analyze
+	ReadError   = "read"   // the other files of the package could not be read
+	ImportError = "import" // a package needed for completion could not be imported
+	CursorError = "cursor" // the cursor offset is outside of the file
+)
+
+// An Error describes a problem that kept gocode from producing
+// suggestions.
+type Error struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+	Stack   string `json:"stack,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s error: %s", e.Kind, e.Message)
+}
+
+// errorImporter wraps an importer to remember the first import that
+// failed.
+type errorImporter struct {
+	imp types.Importer
+	err *Error
+}
+
+func (ei *errorImporter) Import(path string) (*types.Package, error) {
+	return ei.ImportFrom(path, "", 0)
+}
+
+func (ei *errorImporter) ImportFrom(path, srcDir string, mode types.ImportMode) (*types.Package, error) {
+	var pkg *types.Package
+	var err error
+	if from, ok := ei.imp.(types.ImporterFrom); ok {
+		pkg, err = from.ImportFrom(path, srcDir, mode)
+	} else {
+		pkg, err = ei.imp.Import(path)
+	}
+	if err != nil && ei.err == nil {
+		ei.err = &Error{
+			Kind:    ImportError,
+			Message: fmt.Sprintf("could not import %s: %v", path, err),
+		}
+	}
+	return pkg, err
+}
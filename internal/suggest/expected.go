@@ -0,0 +1,261 @@
+package suggest
+
+import (
+	"bytes"
+	"go/ast"
+	"go/token"
+	"go/types"
+)
+
+// Scores added to candidates that fit the type expected at the cursor.
+const (
+	assignableScore = 20 // the candidate itself is assignable
+	callResultScore = 10 // the result of calling it is assignable
+)
+
+// expectedType returns the type of the expression expected at the
+// cursor, given the nodes enclosing it, innermost first: the other
+// side of an assignment or comparison, a parameter of a call, a
+// result of the enclosing function or an element of a composite
+// literal. It returns nil if there's no particular expected type.
+func expectedType(info *types.Info, path []ast.Node) types.Type {
+	for i, n := range path {
+		var child ast.Node
+		if i > 0 {
+			child = path[i-1]
+		}
+
+		if _, ok := n.(ast.Expr); ok && i == 0 {
+			// The operand being completed.
+			continue
+		}
+
+		switch n := n.(type) {
+		case *ast.ParenExpr:
+			continue
+		case *ast.SelectorExpr:
+			if child == n.Sel {
+				continue
+			}
+		case *ast.AssignStmt:
+			j := exprIndex(n.Rhs, child)
+			if n.Tok != token.DEFINE && j >= 0 && len(n.Lhs) == len(n.Rhs) {
+				return info.TypeOf(n.Lhs[j])
+			}
+		case *ast.ValueSpec:
+			if n.Type != nil && exprIndex(n.Values, child) >= 0 {
+				return info.TypeOf(n.Type)
+			}
+		case *ast.CallExpr:
+			if j := exprIndex(n.Args, child); j >= 0 {
+				return paramType(info, n, j)
+			}
+		case *ast.ReturnStmt:
+			j := exprIndex(n.Results, child)
+			if child == nil {
+				// A bare return just before the cursor.
+				j = 0
+			}
+			if sig := enclosingSignature(info, path[i+1:]); sig != nil && j >= 0 && j < sig.Results().Len() {
+				return sig.Results().At(j).Type()
+			}
+		case *ast.BinaryExpr:
+			switch n.Op {
+			case token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ:
+				if child == n.Y {
+					return info.TypeOf(n.X)
+				}
+				return info.TypeOf(n.Y)
+			}
+		case *ast.KeyValueExpr:
+			if lit, ok := parentOf(path, i).(*ast.CompositeLit); ok {
+				return elementType(info, lit, n, child == n.Key)
+			}
+		case *ast.CompositeLit:
+			if j := exprIndex(n.Elts, child); j >= 0 {
+				return positionalType(info, n, j)
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// enclosingPath returns the nodes of file, whose source is data,
+// enclosing pos, innermost first.
+//
+// A return statement without results followed only by blanks up to
+// pos counts as enclosing it, since the parser ends it before the
+// expression being typed.
+func enclosingPath(fset *token.FileSet, file *ast.File, pos token.Pos, data []byte) []ast.Node {
+	tf := fset.File(file.Pos())
+	var path []ast.Node
+	ast.Inspect(file, func(n ast.Node) bool {
+		if n == nil {
+			return false
+		}
+		if n.Pos() <= pos && pos <= n.End() {
+			path = append(path, n)
+			return true
+		}
+		if ret, ok := n.(*ast.ReturnStmt); ok && len(ret.Results) == 0 && ret.End() < pos {
+			if space := data[tf.Offset(ret.End()):tf.Offset(pos)]; len(bytes.Trim(space, " \t")) == 0 {
+				path = append(path, n)
+			}
+		}
+		return false
+	})
+
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+// exprIndex returns the index of n within list, or -1.
+func exprIndex(list []ast.Expr, n ast.Node) int {
+	for i, e := range list {
+		if e == n {
+			return i
+		}
+	}
+	return -1
+}
+
+func parentOf(path []ast.Node, i int) ast.Node {
+	if i+1 < len(path) {
+		return path[i+1]
+	}
+	return nil
+}
+
+// paramType returns the type of the j'th argument of call.
+func paramType(info *types.Info, call *ast.CallExpr, j int) types.Type {
+	tv, ok := info.Types[call.Fun]
+	if !ok || tv.IsType() {
+		return nil
+	}
+	sig, ok := tv.Type.Underlying().(*types.Signature)
+	if !ok {
+		return nil
+	}
+	params := sig.Params()
+	if sig.Variadic() && j >= params.Len()-1 {
+		last := params.At(params.Len() - 1).Type()
+		if call.Ellipsis.IsValid() {
+			return last
+		}
+		if s, ok := last.(*types.Slice); ok {
+			return s.Elem()
+		}
+		return nil
+	}
+	if j < params.Len() {
+		return params.At(j).Type()
+	}
+	return nil
+}
+
+// enclosingSignature returns the signature of the innermost function
+// in path.
+func enclosingSignature(info *types.Info, path []ast.Node) *types.Signature {
+	for _, n := range path {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			sig, _ := info.TypeOf(n).(*types.Signature)
+			return sig
+		case *ast.FuncDecl:
+			if obj := info.Defs[n.Name]; obj != nil {
+				sig, _ := obj.Type().(*types.Signature)
+				return sig
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// elementType returns the type of the key, if isKey is set, or the
+// value of the element kv of lit.
+func elementType(info *types.Info, lit *ast.CompositeLit, kv *ast.KeyValueExpr, isKey bool) types.Type {
+	switch t := literalType(info, lit).(type) {
+	case *types.Struct:
+		if name, ok := kv.Key.(*ast.Ident); ok && !isKey {
+			for i := 0; i < t.NumFields(); i++ {
+				if f := t.Field(i); f.Name() == name.Name {
+					return f.Type()
+				}
+			}
+		}
+	case *types.Map:
+		if isKey {
+			return t.Key()
+		}
+		return t.Elem()
+	case *types.Slice:
+		if !isKey {
+			return t.Elem()
+		}
+	case *types.Array:
+		if !isKey {
+			return t.Elem()
+		}
+	}
+	return nil
+}
+
+// positionalType returns the type of the j'th element of lit, which
+// has no key.
+func positionalType(info *types.Info, lit *ast.CompositeLit, j int) types.Type {
+	switch t := literalType(info, lit).(type) {
+	case *types.Struct:
+		if j < t.NumFields() {
+			return t.Field(j).Type()
+		}
+	case *types.Slice:
+		return t.Elem()
+	case *types.Array:
+		return t.Elem()
+	}
+	return nil
+}
+
+// literalType returns the underlying type of lit, looking through
+// the pointer of elided &T{} literals.
+func literalType(info *types.Info, lit *ast.CompositeLit) types.Type {
+	t := info.TypeOf(lit)
+	if t == nil {
+		return nil
+	}
+	t = t.Underlying()
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem().Underlying()
+	}
+	return t
+}
+
+// typeScore returns how well obj fits the expected type.
+func typeScore(obj types.Object, expected types.Type) int {
+	if expected == nil || expected == types.Typ[types.Invalid] {
+		return 0
+	}
+	if b, ok := expected.(*types.Basic); ok && b.Info()&types.IsUntyped != 0 {
+		// Comparisons with constants expect their default type.
+		expected = types.Default(expected)
+	}
+	switch obj.(type) {
+	case *types.TypeName, *types.PkgName, *types.Builtin, *types.Label:
+		return 0
+	}
+	t := obj.Type()
+	if t == nil || t == types.Typ[types.Invalid] {
+		return 0
+	}
+	if types.AssignableTo(t, expected) {
+		return assignableScore
+	}
+	if sig, ok := t.Underlying().(*types.Signature); ok && sig.Results().Len() == 1 && types.AssignableTo(sig.Results().At(0).Type(), expected) {
+		return callResultScore
+	}
+	return 0
+}
@@ -4,9 +4,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"strings"
 )
 
-type Formatter func(w io.Writer, candidates []Candidate, num int)
+// A Formatter writes candidates in a format suitable for an editor.
+// If err is non-nil, it's reported in a way the editor can show, and
+// if partial is set, so is the fact that candidates may be missing
+// because the server ran out of time.
+type Formatter func(w io.Writer, candidates []Candidate, num int, err *Error, partial bool)
+
+// EditFormats holds the formats that include the Edits of
+// candidates. Candidates that need edits, like members of packages
+// the file doesn't import yet, are only useful in these formats.
+var EditFormats = map[string]bool{
+	"json": true,
+}
 
 var Formatters = map[string]Formatter{
 	"csv":              csvFormat,
@@ -18,7 +30,17 @@ var Formatters = map[string]Formatter{
 	"vim":              vimFormat,
 }
 
-func NiceFormat(w io.Writer, candidates []Candidate, num int) {
+func NiceFormat(w io.Writer, candidates []Candidate, num int, err *Error, partial bool) {
+	if err != nil {
+		fmt.Fprintf(w, "Error (%s): %s\n", err.Kind, err.Message)
+		if err.Stack != "" {
+			fmt.Fprintf(w, "  %s\n", strings.Replace(strings.TrimSpace(err.Stack), "\n", "\n  ", -1))
+		}
+	}
+	if partial {
+		fmt.Fprintf(w, "Partial results: timed out before all packages were loaded.\n")
+	}
+
 	if candidates == nil {
 		fmt.Fprintf(w, "Nothing to complete.\n")
 		return
@@ -30,33 +52,78 @@ func NiceFormat(w io.Writer, candidates []Candidate, num int) {
 	}
 }
 
-func vimFormat(w io.Writer, candidates []Candidate, num int) {
+func vimFormat(w io.Writer, candidates []Candidate, num int, err *Error, partial bool) {
 	if candidates == nil {
-		fmt.Fprint(w, "[0, []]")
-		return
-	}
+		fmt.Fprint(w, "[0, []")
+	} else {
+		fmt.Fprintf(w, "[%d, [", num)
+		for i, c := range candidates {
+			if i != 0 {
+				fmt.Fprintf(w, ", ")
+			}
 
-	fmt.Fprintf(w, "[%d, [", num)
-	for i, c := range candidates {
-		if i != 0 {
-			fmt.Fprintf(w, ", ")
+			word := c.Suggestion()
+			abbr := c.String()
+			fmt.Fprintf(w, "{'word': '%s', 'abbr': '%s', 'info': '%s'", word, abbr, abbr)
+			if c.Matched != nil {
+				fmt.Fprintf(w, ", 'matched': [")
+				for j, r := range c.Matched {
+					if j != 0 {
+						fmt.Fprintf(w, ", ")
+					}
+					fmt.Fprintf(w, "[%d, %d]", r.Start, r.End)
+				}
+				fmt.Fprintf(w, "]")
+			}
+			fmt.Fprintf(w, "}")
 		}
-
-		word := c.Suggestion()
-		abbr := c.String()
-		fmt.Fprintf(w, "{'word': '%s', 'abbr': '%s', 'info': '%s'}", word, abbr, abbr)
+		fmt.Fprintf(w, "]")
 	}
-	fmt.Fprintf(w, "]]")
+	switch {
+	case err != nil && partial:
+		fmt.Fprintf(w, ", {'error': {'kind': '%s', 'message': '%s'}, 'partial': 1}", err.Kind, vimEscape(oneLine(err.Message)))
+	case err != nil:
+		fmt.Fprintf(w, ", {'error': {'kind': '%s', 'message': '%s'}}", err.Kind, vimEscape(oneLine(err.Message)))
+	case partial:
+		fmt.Fprintf(w, ", {'partial': 1}")
+	}
+	fmt.Fprintf(w, "]")
+}
+
+// vimEscape escapes s for use in a single-quoted Vim string.
+func vimEscape(s string) string {
+	return strings.Replace(s, "'", "''", -1)
 }
 
-func goditFormat(w io.Writer, candidates []Candidate, num int) {
-	fmt.Fprintf(w, "%d,,%d\n", num, len(candidates))
+func goditFormat(w io.Writer, candidates []Candidate, num int, err *Error, partial bool) {
+	n := len(candidates)
+	if err != nil {
+		n++
+	}
+	if partial {
+		n++
+	}
+	fmt.Fprintf(w, "%d,,%d\n", num, n)
+	if err != nil {
+		fmt.Fprintf(w, "%s error: %s,,\n", err.Kind, oneLine(err.Message))
+	}
+	if partial {
+		fmt.Fprintf(w, "partial results: timed out,,\n")
+	}
 	for _, c := range candidates {
 		fmt.Fprintf(w, "%s,,%s\n", c.String(), c.Suggestion())
 	}
 }
 
-func emacsFormat(w io.Writer, candidates []Candidate, num int) {
+func emacsFormat(w io.Writer, candidates []Candidate, num int, err *Error, partial bool) {
+	if err != nil {
+		// "gocode-error" can't be a Go identifier, so it can't
+		// be mistaken for a candidate.
+		fmt.Fprintf(w, "gocode-error,,%s: %s\n", err.Kind, oneLine(err.Message))
+	}
+	if partial {
+		fmt.Fprintf(w, "gocode-partial,,timed out before all packages were loaded\n")
+	}
 	for _, c := range candidates {
 		var hint string
 		switch {
@@ -71,16 +138,36 @@ func emacsFormat(w io.Writer, candidates []Candidate, num int) {
 	}
 }
 
-func csvFormat(w io.Writer, candidates []Candidate, num int) {
+func csvFormat(w io.Writer, candidates []Candidate, num int, err *Error, partial bool) {
+	if err != nil {
+		fmt.Fprintf(w, "error,,%s,,%s,,\n", err.Kind, oneLine(err.Message))
+	}
+	if partial {
+		fmt.Fprintf(w, "partial,,,,,,\n")
+	}
 	for _, c := range candidates {
 		fmt.Fprintf(w, "%s,,%s,,%s,,%s\n", c.Class, c.Name, c.Type, c.PkgPath)
 	}
 }
 
-func jsonFormat(w io.Writer, candidates []Candidate, num int) {
+func jsonFormat(w io.Writer, candidates []Candidate, num int, err *Error, partial bool) {
 	var x []interface{}
 	if candidates != nil {
 		x = []interface{}{num, candidates}
 	}
+	if err != nil || partial {
+		if x == nil {
+			x = []interface{}{0, []Candidate{}}
+		}
+		x = append(x, struct {
+			Error   *Error `json:"error,omitempty"`
+			Partial bool   `json:"partial,omitempty"`
+		}{err, partial})
+	}
 	json.NewEncoder(w).Encode(x)
 }
+
+// oneLine flattens s for formats that are parsed line by line.
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
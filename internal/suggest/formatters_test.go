@@ -95,7 +95,144 @@ func,,client_status,,func(cli *rpc.Client, Arg0 int) string,,gocode
 
 	for _, test := range tests {
 		var out bytes.Buffer
-		suggest.Formatters[test.name](&out, candidates, num)
+		suggest.Formatters[test.name](&out, candidates, num, nil, false)
+
+		if got := out.String(); got != test.want {
+			t.Errorf("Format %s:\nGot:\n%q\nWant:\n%q\n", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFormattersError(t *testing.T) {
+	err := &suggest.Error{
+		Kind:    suggest.ImportError,
+		Message: "could not import foo (can't find 'foo')",
+	}
+
+	var tests = [...]struct {
+		name string
+		want string
+	}{
+		{"json", `[0,[],{"error":{"kind":"import","message":"could not import foo (can't find 'foo')"}}]
+`},
+		{"nice", `Error (import): could not import foo (can't find 'foo')
+Nothing to complete.
+`},
+		{"vim", `[0, [], {'error': {'kind': 'import', 'message': 'could not import foo (can''t find ''foo'')'}}]`},
+		{"godit", `0,,1
+import error: could not import foo (can't find 'foo'),,
+`},
+		{"emacs", `gocode-error,,import: could not import foo (can't find 'foo')
+`},
+		{"csv", `error,,import,,could not import foo (can't find 'foo'),,
+`},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		suggest.Formatters[test.name](&out, nil, 0, err, false)
+
+		if got := out.String(); got != test.want {
+			t.Errorf("Format %s:\nGot:\n%q\nWant:\n%q\n", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFormattersMatched(t *testing.T) {
+	candidates := []suggest.Candidate{{
+		Class:   "func",
+		PkgPath: "io/ioutil",
+		Name:    "ReadAll",
+		Type:    "func(r io.Reader) ([]byte, error)",
+		Matched: []suggest.Range{{0, 1}, {3, 7}},
+	}}
+
+	var tests = [...]struct {
+		name string
+		want string
+	}{
+		{"json", `[5,[{"class":"func","package":"io/ioutil","name":"ReadAll","type":"func(r io.Reader) ([]byte, error)","matched":[{"start":0,"end":1},{"start":3,"end":7}]}]]
+`},
+		{"vim", `[5, [{'word': 'ReadAll(', 'abbr': 'func ReadAll(r io.Reader) ([]byte, error)', 'info': 'func ReadAll(r io.Reader) ([]byte, error)', 'matched': [[0, 1], [3, 7]]}]]`},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		suggest.Formatters[test.name](&out, candidates, len("rdall"), nil, false)
+
+		if got := out.String(); got != test.want {
+			t.Errorf("Format %s:\nGot:\n%q\nWant:\n%q\n", test.name, got, test.want)
+		}
+	}
+
+	// The other formats don't carry the ranges.
+	unmatched := []suggest.Candidate{candidates[0]}
+	unmatched[0].Matched = nil
+	for name, format := range suggest.Formatters {
+		if name == "json" || name == "vim" {
+			continue
+		}
+		var got, want bytes.Buffer
+		format(&got, candidates, len("rdall"), nil, false)
+		format(&want, unmatched, len("rdall"), nil, false)
+		if got.String() != want.String() {
+			t.Errorf("Format %s:\nGot:\n%q\nWant:\n%q\n", name, got.String(), want.String())
+		}
+	}
+}
+
+func TestFormattersPartial(t *testing.T) {
+	candidates := []suggest.Candidate{{
+		Class:   "func",
+		PkgPath: "io/ioutil",
+		Name:    "ReadAll",
+		Type:    "func(r io.Reader) ([]byte, error)",
+	}}
+
+	var tests = [...]struct {
+		name string
+		want string
+	}{
+		{"json", `[4,[{"class":"func","package":"io/ioutil","name":"ReadAll","type":"func(r io.Reader) ([]byte, error)"}],{"partial":true}]
+`},
+		{"nice", `Partial results: timed out before all packages were loaded.
+Found 1 candidates:
+  func ReadAll(r io.Reader) ([]byte, error)
+`},
+		{"vim", `[4, [{'word': 'ReadAll(', 'abbr': 'func ReadAll(r io.Reader) ([]byte, error)', 'info': 'func ReadAll(r io.Reader) ([]byte, error)'}], {'partial': 1}]`},
+		{"godit", `4,,2
+partial results: timed out,,
+func ReadAll(r io.Reader) ([]byte, error),,ReadAll(
+`},
+		{"emacs", `gocode-partial,,timed out before all packages were loaded
+ReadAll,,func(r io.Reader) ([]byte, error)
+`},
+		{"csv", `partial,,,,,,
+func,,ReadAll,,func(r io.Reader) ([]byte, error),,io/ioutil
+`},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		suggest.Formatters[test.name](&out, candidates, len("Read"), nil, true)
+
+		if got := out.String(); got != test.want {
+			t.Errorf("Format %s:\nGot:\n%q\nWant:\n%q\n", test.name, got, test.want)
+		}
+	}
+
+	// Errors and partial results can be reported together.
+	err := &suggest.Error{Kind: suggest.ImportError, Message: "could not import foo"}
+	for _, test := range [...]struct {
+		name string
+		want string
+	}{
+		{"json", `[0,[],{"error":{"kind":"import","message":"could not import foo"},"partial":true}]
+`},
+		{"vim", `[0, [], {'error': {'kind': 'import', 'message': 'could not import foo'}, 'partial': 1}]`},
+	} {
+		var out bytes.Buffer
+		suggest.Formatters[test.name](&out, nil, 0, err, true)
 
 		if got := out.String(); got != test.want {
 			t.Errorf("Format %s:\nGot:\n%q\nWant:\n%q\n", test.name, got, test.want)
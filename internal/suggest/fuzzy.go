@@ -0,0 +1,134 @@
+package suggest
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Range is the half-open range [Start, End) of byte offsets within
+// a candidate's name.
+type Range struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Scores for the characters of a fuzzy match.
+const (
+	fuzzyChar        = 1 // any matched character
+	fuzzySameCase    = 1 // ... typed in the same case
+	fuzzyWordStart   = 8 // ... starting a camelCase hump or word
+	fuzzyConsecutive = 4 // ... right after the previous match
+	fuzzyPrefix      = 2 // ... at the very start of the name
+)
+
+// fuzzyMatch reports whether the characters of pattern appear in
+// name in order, ignoring case. If so, it also returns a score, higher
+// for better matches, and the ranges of name that were matched.
+//
+// Matches at the start of camelCase humps, like "RA" or "rdall" for
+// "ReadAll", and runs of consecutive characters score highest.
+func fuzzyMatch(pattern, name string) (int, []Range, bool) {
+	p, n := []rune(pattern), []rune(name)
+	if len(p) == 0 {
+		return 0, nil, true
+	}
+	if len(p) > len(n) {
+		return 0, nil, false
+	}
+
+	// best[i][j] is the best score for matching p[:i+1] with p[i]
+	// at n[j], or -1 if there's no such match. prev[i][j] is where
+	// p[i-1] matched in that case.
+	best := make([][]int, len(p))
+	prev := make([][]int, len(p))
+	for i := range p {
+		best[i] = make([]int, len(n))
+		prev[i] = make([]int, len(n))
+		for j := range n {
+			best[i][j] = -1
+			if unicode.ToLower(p[i]) != unicode.ToLower(n[j]) {
+				continue
+			}
+			score := fuzzyChar
+			if p[i] == n[j] {
+				score += fuzzySameCase
+			}
+			if wordStart(n, j) {
+				score += fuzzyWordStart
+			}
+
+			if i == 0 {
+				if j == 0 {
+					score += fuzzyPrefix
+				}
+				best[i][j] = score
+				continue
+			}
+			for k := i - 1; k < j; k++ {
+				if best[i-1][k] < 0 {
+					continue
+				}
+				s := best[i-1][k] + score
+				if k == j-1 {
+					s += fuzzyConsecutive
+				}
+				if s > best[i][j] {
+					best[i][j], prev[i][j] = s, k
+				}
+			}
+		}
+	}
+
+	last := len(p) - 1
+	end := -1
+	for j := range n {
+		if best[last][j] >= 0 && (end < 0 || best[last][j] > best[last][end]) {
+			end = j
+		}
+	}
+	if end < 0 {
+		return 0, nil, false
+	}
+
+	// Walk back through the match, collecting runs of consecutive
+	// characters.
+	positions := make([]int, len(p))
+	positions[last] = end
+	for i := last; i > 0; i-- {
+		positions[i-1] = prev[i][positions[i]]
+	}
+	var ranges []Range
+	for i, j := range positions {
+		start := len(string(n[:j]))
+		stop := start + utf8.RuneLen(n[j])
+		if i > 0 && positions[i-1] == j-1 {
+			ranges[len(ranges)-1].End = stop
+		} else {
+			ranges = append(ranges, Range{start, stop})
+		}
+	}
+	return best[last][end], ranges, true
+}
+
+// wordStart reports whether name[i] starts a word within name: it's
+// the first character, follows an underscore or digit boundary, or
+// starts a camelCase hump like the "R" in "ReadAll" and "HTTPRequest".
+func wordStart(name []rune, i int) bool {
+	if i == 0 {
+		return true
+	}
+	c, before := name[i], name[i-1]
+	switch {
+	case before == '_':
+		return c != '_'
+	case unicode.IsDigit(c):
+		return !unicode.IsDigit(before)
+	case unicode.IsUpper(c):
+		if !unicode.IsUpper(before) {
+			return true
+		}
+		// The last capital of an acronym starts the next word.
+		return i+1 < len(name) && unicode.IsLower(name[i+1])
+	}
+	return false
+}
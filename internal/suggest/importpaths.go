@@ -0,0 +1,91 @@
+package suggest
+
+import (
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// importPathCandidates returns the candidates for the import path
+// being typed at cursor, and the length of its last element before
+// the cursor. Paths are completed an element at a time: the packages
+// one element below the elements already typed, and the directories
+// holding packages further below, with a trailing slash. ok is false
+// if the cursor isn't inside the path of an import declaration.
+func (c *Config) importPathCandidates(filename string, data []byte, cursor int) (res []Candidate, n int, ok bool) {
+	if c.ImportPaths == nil {
+		return nil, 0, false
+	}
+	typed, ok := importPathAt(filename, data, cursor)
+	if !ok {
+		return nil, 0, false
+	}
+
+	i := strings.LastIndex(typed, "/") + 1
+	prefix := typed[:i]
+	dirs := make(map[string]bool)
+	for path, dir := range c.ImportPaths(filepath.Dir(filename)) {
+		if !strings.HasPrefix(path, typed) {
+			continue
+		}
+		elem := path[len(prefix):]
+		if j := strings.IndexByte(elem, '/'); j >= 0 {
+			elem = elem[:j+1]
+			if !dirs[elem] {
+				dirs[elem] = true
+				res = append(res, Candidate{Class: "import", PkgPath: prefix + elem[:j], Name: elem})
+			}
+			continue
+		}
+
+		name, doc := c.packageDoc(dir)
+		if name == "" {
+			continue
+		}
+		res = append(res, Candidate{
+			Class:   "import",
+			PkgPath: path,
+			Name:    elem,
+			Type:    name,
+			Doc:     doc,
+		})
+	}
+	sort.Sort(candidatesByScore(res))
+	return res, len(typed) - i, true
+}
+
+// packageDoc returns the name and documentation of the package in
+// dir, or empty strings if no Go files there match the build
+// constraints.
+func (c *Config) packageDoc(dir string) (name, doc string) {
+	if c.PackageDoc != nil {
+		return c.PackageDoc(dir)
+	}
+	// ImportDir always returns a package, but without a name if
+	// no Go files match the build constraints.
+	bp, _ := c.buildContext().ImportDir(dir, 0)
+	return bp.Name, bp.Doc
+}
+
+// importPathAt returns the part of the import path before cursor, if
+// the cursor is inside the path of one of the file's imports.
+func importPathAt(filename string, data []byte, cursor int) (string, bool) {
+	fset := token.NewFileSet()
+	file, _ := parser.ParseFile(fset, filename, data, parser.ImportsOnly)
+	if file == nil {
+		return "", false
+	}
+	for _, spec := range file.Imports {
+		lit := spec.Path
+		off := cursor - fset.Position(lit.Pos()).Offset
+		// A path that isn't terminated yet runs to the end of
+		// the line, and the cursor can be at its end.
+		closed := len(lit.Value) >= 2 && lit.Value[len(lit.Value)-1] == lit.Value[0]
+		if off >= 1 && (off < len(lit.Value) || !closed && off == len(lit.Value)) {
+			return lit.Value[1:off], true
+		}
+	}
+	return "", false
+}
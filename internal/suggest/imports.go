@@ -0,0 +1,86 @@
+package suggest
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"strconv"
+)
+
+// An Edit replaces Length bytes at byte offset Offset of the file
+// being completed with Text.
+type Edit struct {
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+	Text   string `json:"text"`
+}
+
+// unimportedCandidates adds the members of the package named name to
+// b, if the file doesn't import it yet but c.FindPackage finds one.
+// It returns the edit that adds the import, or nil.
+func (c *Config) unimportedCandidates(fset *token.FileSet, file *ast.File, filename, name string, cursor int, b *candidateCollector) *Edit {
+	if c.FindPackage == nil {
+		return nil
+	}
+	dir := filepath.Dir(filename)
+	path := c.FindPackage(name, dir)
+	if path == "" {
+		return nil
+	}
+
+	var pkg *types.Package
+	var err error
+	if from, ok := c.Importer.(types.ImporterFrom); ok {
+		pkg, err = from.ImportFrom(path, dir, 0)
+	} else {
+		pkg, err = c.Importer.Import(path)
+	}
+	if err != nil || pkg.Name() != name {
+		return nil
+	}
+
+	c.packageCandidates(pkg, b)
+	edit := importEdit(fset, file, path, cursor)
+	return &edit
+}
+
+// importEdit returns the edit that adds an import of path to file,
+// which was parsed with a semicolon inserted at the cursor. The
+// import goes into the first import declaration, among the other
+// imports in sorted order if it's parenthesized.
+func importEdit(fset *token.FileSet, file *ast.File, path string, cursor int) Edit {
+	tf := fset.File(file.Pos())
+	offset := func(pos token.Pos) int {
+		off := tf.Offset(pos)
+		if off > cursor {
+			// Past the semicolon.
+			off--
+		}
+		return off
+	}
+	lineStart := func(pos token.Pos) int {
+		return offset(tf.LineStart(tf.Line(pos)))
+	}
+	quoted := strconv.Quote(path)
+
+	for _, decl := range file.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.IMPORT {
+			continue
+		}
+		if !gd.Lparen.IsValid() {
+			return Edit{Offset: offset(gd.End()), Text: "\nimport " + quoted}
+		}
+		for _, spec := range gd.Specs {
+			if is := spec.(*ast.ImportSpec); is.Path.Value > quoted {
+				return Edit{Offset: lineStart(is.Pos()), Text: "\t" + quoted + "\n"}
+			}
+		}
+		if n := len(gd.Specs); n > 0 && tf.Line(gd.Specs[n-1].End()) < tf.Line(gd.Rparen) {
+			return Edit{Offset: lineStart(gd.Rparen), Text: "\t" + quoted + "\n"}
+		}
+		return Edit{Offset: offset(gd.Rparen), Text: "\n\t" + quoted + "\n"}
+	}
+	return Edit{Offset: offset(file.Name.End()), Text: "\n\nimport " + quoted}
+}
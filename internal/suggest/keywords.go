@@ -0,0 +1,112 @@
+package suggest
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+// keywords returns the keywords that can be typed at pos, given the
+// nodes enclosing it, innermost first: declaration keywords at file
+// scope, and statement keywords at the start of a statement, as far
+// as the enclosing statements allow them.
+func keywords(file *ast.File, path []ast.Node, pos token.Pos) []string {
+	// Skip the identifier being typed, if any.
+	if len(path) > 0 {
+		switch path[0].(type) {
+		case *ast.Ident, *ast.BadExpr:
+			path = path[1:]
+		}
+	}
+	if len(path) == 0 {
+		return nil
+	}
+
+	switch n := path[0].(type) {
+	case *ast.File, *ast.BadDecl:
+		return topLevelKeywords(file, pos)
+	case *ast.ForStmt:
+		if pos < n.Body.Lbrace {
+			// for range x
+			return []string{"range"}
+		}
+	case *ast.AssignStmt:
+		if len(path) > 1 && (n.Tok == token.DEFINE || n.Tok == token.ASSIGN) {
+			if loop, ok := path[1].(*ast.ForStmt); ok && loop.Init == n && pos < loop.Body.Lbrace {
+				// for k, v := range x
+				return []string{"range"}
+			}
+		}
+	case *ast.ExprStmt, *ast.EmptyStmt:
+		return statementKeywords(path[1:])
+	case *ast.BlockStmt:
+		return statementKeywords(path)
+	}
+	return nil
+}
+
+// topLevelKeywords returns the keywords that can start a declaration
+// at pos, at file scope.
+func topLevelKeywords(file *ast.File, pos token.Pos) []string {
+	kws := []string{"const", "func", "type", "var"}
+	for _, decl := range file.Decls {
+		if gd, ok := decl.(*ast.GenDecl); decl.End() <= pos && (!ok || gd.Tok != token.IMPORT) {
+			// Imports must come first.
+			return kws
+		}
+	}
+	return append(kws, "import")
+}
+
+// statementKeywords returns the keywords that can start a statement
+// directly within path[0].
+func statementKeywords(path []ast.Node) []string {
+	if len(path) == 0 {
+		return nil
+	}
+	var kws []string
+	switch n := path[0].(type) {
+	case *ast.BlockStmt:
+		if len(path) > 1 {
+			switch path[1].(type) {
+			case *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+				// Only clauses go here.
+				return []string{"case", "default"}
+			}
+		}
+	case *ast.CaseClause:
+		kws = append(kws, "case", "default")
+		if len(path) > 2 {
+			body, _ := path[1].(*ast.BlockStmt)
+			if _, ok := path[2].(*ast.SwitchStmt); ok && body != nil && body.List[len(body.List)-1] != n {
+				// Not the final case.
+				kws = append(kws, "fallthrough")
+			}
+		}
+	case *ast.CommClause:
+		kws = append(kws, "case", "default")
+	default:
+		return nil
+	}
+
+	kws = append(kws, "const", "defer", "for", "go", "goto", "if", "return", "select", "switch", "type", "var")
+
+	var loop, breakable bool
+outer:
+	for _, n := range path {
+		switch n.(type) {
+		case *ast.ForStmt, *ast.RangeStmt:
+			loop, breakable = true, true
+		case *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+			breakable = true
+		case *ast.FuncLit, *ast.FuncDecl:
+			break outer
+		}
+	}
+	if breakable {
+		kws = append(kws, "break")
+	}
+	if loop {
+		kws = append(kws, "continue")
+	}
+	return kws
+}
@@ -0,0 +1,157 @@
+package suggest
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A ParseCache holds parsed sibling package files across completion
+// requests. Files are reparsed only when their size or modification
+// time changes.
+//
+// Cached files have all function bodies removed, since sibling
+// files never contain the cursor.
+type ParseCache struct {
+	fset *token.FileSet
+
+	mu    sync.Mutex
+	files map[string]*parsedFile
+}
+
+type parsedFile struct {
+	size    int64
+	modTime time.Time
+
+	// src holds the contents the file was parsed from, if they
+	// came from an overlay rather than from disk.
+	src []byte
+
+	// done is closed once the file has been parsed into file,
+	// tf and err.
+	done chan struct{}
+	file *ast.File
+	tf   *token.File
+	err  error
+}
+
+func NewParseCache() *ParseCache {
+	return &ParseCache{
+		fset:  token.NewFileSet(),
+		files: make(map[string]*parsedFile),
+	}
+}
+
+// Len returns the number of files currently held by pc.
+func (pc *ParseCache) Len() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return len(pc.files)
+}
+
+// Drop removes the files whose directory satisfies match from pc
+// and returns how many were removed.
+func (pc *ParseCache) Drop(match func(dir string) bool) int {
+	var dropped []*parsedFile
+	pc.mu.Lock()
+	for filename, pf := range pc.files {
+		if match(filepath.Dir(filename)) {
+			dropped = append(dropped, pf)
+			delete(pc.files, filename)
+		}
+	}
+	pc.mu.Unlock()
+
+	for _, pf := range dropped {
+		pc.release(pf)
+	}
+	return len(dropped)
+}
+
+// parseFile returns the AST for filename, parsed from src if it's
+// non-nil or else from disk, and its token.File. The file belongs to
+// pc.fset; callers must add it to their own FileSet with
+// AddExistingFiles.
+//
+// Files are parsed without holding pc.mu, so requests only wait for
+// each other when they need the same file.
+func (pc *ParseCache) parseFile(filename string, src []byte) (*ast.File, *token.File, error) {
+	var fi os.FileInfo
+	if src == nil {
+		var err error
+		fi, err = os.Stat(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	pc.mu.Lock()
+	old := pc.files[filename]
+	if old != nil && old.matches(fi, src) {
+		pc.mu.Unlock()
+		<-old.done
+		return old.file, old.tf, old.err
+	}
+	pf := &parsedFile{
+		src:  src,
+		done: make(chan struct{}),
+	}
+	if fi != nil {
+		pf.size, pf.modTime = fi.Size(), fi.ModTime()
+	}
+	pc.files[filename] = pf
+	pc.mu.Unlock()
+
+	pf.file, pf.err = parseStripped(pc.fset, filename, src)
+	if pf.file != nil {
+		pf.tf = pc.fset.File(pf.file.FileStart)
+	}
+	close(pf.done)
+
+	if old != nil {
+		pc.release(old)
+	}
+	return pf.file, pf.tf, pf.err
+}
+
+// matches reports whether pf was parsed from src or, if src is nil,
+// from the file on disk described by fi.
+func (pf *parsedFile) matches(fi os.FileInfo, src []byte) bool {
+	if src != nil {
+		return bytes.Equal(pf.src, src)
+	}
+	return pf.src == nil && pf.size == fi.Size() && pf.modTime.Equal(fi.ModTime())
+}
+
+// release removes pf, which is no longer in pc.files, from pc.fset
+// once it has been parsed.
+func (pc *ParseCache) release(pf *parsedFile) {
+	<-pf.done
+	if pf.tf != nil {
+		pc.fset.RemoveFile(pf.tf)
+	}
+}
+
+// parseStripped parses filename, or src if it's non-nil, and clears
+// all function bodies.
+func parseStripped(fset *token.FileSet, filename string, src []byte) (*ast.File, error) {
+	var s interface{}
+	if src != nil {
+		s = src
+	}
+	file, err := parser.ParseFile(fset, filename, s, 0)
+	if file == nil {
+		return nil, err
+	}
+	for _, decl := range file.Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok {
+			fd.Body = nil
+		}
+	}
+	return file, err
+}
@@ -0,0 +1,115 @@
+package suggest
+
+import (
+	"go/ast"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseCache(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a", "a.go")
+	b := filepath.Join(dir, "b", "b.go")
+	write := func(name, src string, mtime time.Time) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	then := time.Now().Add(-time.Hour)
+	write(a, "package a\n\nfunc A() { println() }\n", then)
+	write(b, "package b\n", then)
+
+	pc := NewParseCache()
+	parse := func(name string, src []byte) *parsedFile {
+		t.Helper()
+		file, tf, err := pc.parseFile(name, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pc.fset.File(file.FileStart) != tf {
+			t.Fatalf("%s isn't in the cache's FileSet", name)
+		}
+		return &parsedFile{file: file, tf: tf}
+	}
+
+	a1 := parse(a, nil)
+	if parse(a, nil).file != a1.file {
+		t.Errorf("unchanged file was parsed again")
+	}
+	parse(b, nil)
+	if n := pc.Len(); n != 2 {
+		t.Errorf("Len() = %d, want 2", n)
+	}
+
+	// Changing the modification time invalidates the entry, and
+	// the old file is released.
+	write(a, "package a\n\nfunc A2() {}\n", time.Now())
+	a2 := parse(a, nil)
+	if a2.file == a1.file || a2.file.Name.Name != "a" || a2.file.Decls[0].(*ast.FuncDecl).Name.Name != "A2" {
+		t.Errorf("changed file wasn't reparsed")
+	}
+	if pc.fset.File(a1.file.FileStart) != nil {
+		t.Errorf("stale file is still in the cache's FileSet")
+	}
+
+	// Overlaid contents are cached by value.
+	o1 := parse(a, []byte("package a\n\nfunc O() {}\n"))
+	if o1.file == a2.file {
+		t.Errorf("overlay didn't replace the file on disk")
+	}
+	if parse(a, []byte("package a\n\nfunc O() {}\n")).file != o1.file {
+		t.Errorf("unchanged overlay was parsed again")
+	}
+	if parse(a, nil).file == o1.file {
+		t.Errorf("file on disk was taken from the overlay")
+	}
+
+	// Dropping a directory releases only its files.
+	if n := pc.Drop(func(d string) bool { return d == filepath.Dir(a) }); n != 1 {
+		t.Errorf("Drop removed %d files, want 1", n)
+	}
+	if n := pc.Len(); n != 1 {
+		t.Errorf("Len() after Drop = %d, want 1", n)
+	}
+}
+
+func TestParseCacheConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	var names []string
+	for _, name := range []string{"a.go", "b.go", "c.go"} {
+		name = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(name, []byte("package p\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+
+	// Requests for the same file share a single parse.
+	pc := NewParseCache()
+	var wg sync.WaitGroup
+	files := make([]interface{}, 3*len(names))
+	for i := range files {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			files[i], _, _ = pc.parseFile(names[i%len(names)], nil)
+		}(i)
+	}
+	wg.Wait()
+	for i := len(names); i < len(files); i++ {
+		if files[i] != files[i%len(names)] {
+			t.Errorf("%s was parsed more than once", names[i%len(names)])
+		}
+	}
+}
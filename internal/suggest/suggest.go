@@ -2,13 +2,18 @@ package suggest
 
 import (
 	"bytes"
+	"fmt"
 	"go/ast"
+	"go/build"
 	"go/parser"
 	"go/scanner"
 	"go/token"
 	"go/types"
+	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/mdempsky/gocode/internal/lookdot"
@@ -18,32 +23,87 @@ type Config struct {
 	Importer types.Importer
 	Logf     func(fmt string, args ...interface{})
 	Builtin  bool
+
+	// ParseCache, if non-nil, is used to reuse parsed sibling
+	// files across calls to Suggest.
+	ParseCache *ParseCache
+
+	// BuildContext determines which sibling files are part of the
+	// package, based on their names and build constraints. If
+	// nil, build.Default is used.
+	BuildContext *build.Context
+
+	// Overlay holds the contents of files with unsaved changes,
+	// keyed by absolute filename. They're used instead of the
+	// sibling files on disk, and files that only exist in
+	// Overlay are part of their directory's package too.
+	Overlay map[string][]byte
+
+	// Fuzzy selects fuzzy matching of the partial identifier
+	// before the cursor: candidates only need to contain its
+	// characters in order, and the best matches come first.
+	Fuzzy bool
+
+	// FindPackage, if non-nil, returns the import path of a
+	// package named name that files in dir can import, or "".
+	// It's used to complete members of packages that the file
+	// doesn't import yet.
+	FindPackage func(name, dir string) string
+
+	// ImportPaths, if non-nil, returns the import paths of the
+	// packages that files in dir can import, mapped to their
+	// directories. It's used to complete import paths.
+	ImportPaths func(dir string) map[string]string
+
+	// PackageDoc, if non-nil, returns the name and documentation
+	// of the package in dir, or empty strings if there's none.
+	// It's only called for the import paths proposed, and
+	// defaults to reading them with BuildContext.
+	PackageDoc func(dir string) (name, doc string)
 }
 
 // Suggest returns a list of suggestion candidates and the length of
 // the text that should be replaced, if any.
-func (c *Config) Suggest(filename string, data []byte, cursor int) ([]Candidate, int) {
-	if cursor < 0 {
-		return nil, 0
+//
+// If no candidates could be found because of a problem with the
+// input or its dependencies, Suggest also returns an *Error
+// describing it.
+func (c *Config) Suggest(filename string, data []byte, cursor int) ([]Candidate, int, error) {
+	if cursor < 0 || cursor > len(data) {
+		return nil, 0, &Error{
+			Kind:    CursorError,
+			Message: fmt.Sprintf("cursor offset %d outside of file (length %d)", cursor, len(data)),
+		}
+	}
+
+	if res, n, ok := c.importPathCandidates(filename, data, cursor); ok {
+		if len(res) == 0 {
+			return nil, 0, nil
+		}
+		return res, n, nil
 	}
 
-	fset, pos, pkg := c.analyzePackage(filename, data, cursor)
+	fset, pos, pkg, file, info, err := c.analyzePackage(filename, data, cursor)
 	if pkg == nil {
-		return nil, 0
+		return nil, 0, err
 	}
 	scope := pkg.Scope().Innermost(pos)
 
 	ctx, expr, partial := deduceCursorContext(data, cursor)
+	path := enclosingPath(fset, file, pos, data)
 	b := candidateCollector{
 		localpkg: pkg,
 		partial:  partial,
-		filter:   objectFilters[partial],
 		builtin:  ctx != selectContext && c.Builtin,
+		useFuzzy: c.Fuzzy,
+		expected: expectedType(info, path),
 	}
 
+	var edits []Edit
 	switch ctx {
 	case selectContext:
-		tv, _ := types.Eval(fset, pkg, pos, expr)
+		b.filter = objectFilters[partial]
+		tv := evalOperand(fset, pkg, pos, info, expr, operandEnd(data, cursor, partial, pos))
 		if lookdot.Walk(&tv, b.appendObject) {
 			break
 		}
@@ -54,7 +114,14 @@ func (c *Config) Suggest(filename string, data []byte, cursor int) ([]Candidate,
 			break
 		}
 
-		return nil, 0
+		if obj == nil && token.IsIdentifier(expr) {
+			if edit := c.unimportedCandidates(fset, file, filename, expr, cursor, &b); edit != nil {
+				edits = []Edit{*edit}
+				break
+			}
+		}
+
+		return nil, 0, err
 
 	case compositeLiteralContext:
 		tv, _ := types.Eval(fset, pkg, pos, expr)
@@ -68,62 +135,172 @@ func (c *Config) Suggest(filename string, data []byte, cursor int) ([]Candidate,
 		fallthrough
 	default:
 		c.scopeCandidates(scope, pos, &b)
+		if partial != "" {
+			// Keywords would only crowd out the objects in
+			// scope until something's typed.
+			for _, kw := range keywords(file, path, pos) {
+				b.appendKeyword(kw)
+			}
+		}
 	}
 
 	res := b.getCandidates()
 	if len(res) == 0 {
-		return nil, 0
+		return nil, 0, err
+	}
+	for i := range res {
+		res[i].Edits = edits
 	}
-	return res, len(partial)
+	return res, len(partial), nil
 }
 
-func (c *Config) analyzePackage(filename string, data []byte, cursor int) (*token.FileSet, token.Pos, *types.Package) {
+// analyzePackage type-checks the package containing filename, and
+// returns it along with the parsed file and the position of the
+// cursor in it. If the package can't be analyzed, or one of its
+// imports fails, analyzePackage also returns an *Error describing
+// the problem.
+func (c *Config) analyzePackage(filename string, data []byte, cursor int) (*token.FileSet, token.Pos, *types.Package, *ast.File, *types.Info, error) {
 	// If we're in trailing white space at the end of a scope,
 	// sometimes go/types doesn't recognize that variables should
 	// still be in scope there.
-	if cursor > len(data) {
-		return nil, token.NoPos, nil
-	}
 	filesemi := bytes.Join([][]byte{data[:cursor], []byte(";"), data[cursor:]}, nil)
 
+	// Other files are parsed first, because files from the parse
+	// cache must be added to fset before anything else.
 	fset := token.NewFileSet()
+	var others []*ast.File
+	var xtest *xtestImporter
+	if header, _ := parser.ParseFile(token.NewFileSet(), filename, filesemi, parser.PackageClauseOnly); header != nil && header.Name != nil {
+		pkgName := header.Name.Name
+		isXTest := strings.HasSuffix(pkgName, "_test")
+		tests := isXTest || strings.HasSuffix(filename, "_test.go")
+		names, err := c.findOtherPackageFiles(filename, pkgName, tests)
+		if err == nil {
+			others = c.parseOtherFiles(fset, names)
+			if isXTest {
+				xtest, err = c.newXTestImporter(fset, filename, strings.TrimSuffix(pkgName, "_test"))
+			}
+		}
+		if err != nil {
+			return nil, token.NoPos, nil, nil, nil, &Error{
+				Kind:    ReadError,
+				Message: err.Error(),
+			}
+		}
+	}
+
 	fileAST, err := parser.ParseFile(fset, filename, filesemi, parser.AllErrors)
 	if err != nil {
 		c.logParseError("Error parsing input file (outer block)", err)
 	}
 	astPos := fileAST.Pos()
 	if astPos == 0 {
-		return nil, token.NoPos, nil
-	}
-	pos := fset.File(astPos).Pos(cursor)
-
-	files := []*ast.File{fileAST}
-	for _, otherName := range c.findOtherPackageFiles(filename, fileAST.Name.Name) {
-		ast, err := parser.ParseFile(fset, otherName, nil, 0)
-		if err != nil {
-			c.logParseError("Error parsing other file", err)
+		return nil, token.NoPos, nil, nil, nil, &Error{
+			Kind:    ParseError,
+			Message: firstError(err),
 		}
-		files = append(files, ast)
 	}
+	pos := fset.File(astPos).Pos(cursor)
 
 	// Clear any function bodies other than where the cursor
 	// is. They're not relevant to suggestions and only slow down
-	// typechecking.
-	for _, file := range files {
-		for _, decl := range file.Decls {
-			if fd, ok := decl.(*ast.FuncDecl); ok && (pos < fd.Pos() || pos >= fd.End()) {
-				fd.Body = nil
-			}
+	// typechecking. Other files never contain the cursor, so
+	// parseOtherFile already cleared theirs.
+	for _, decl := range fileAST.Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok && (pos < fd.Pos() || pos >= fd.End()) {
+			fd.Body = nil
 		}
 	}
 
+	files := append([]*ast.File{fileAST}, others...)
+
+	// The package is created up front so that the fields of C
+	// structs can belong to it, as they do in cgo's generated code.
+	pkg := types.NewPackage("", "")
+	imp := &errorImporter{imp: c.Importer}
+	var from types.ImporterFrom = imp
+	if xtest != nil {
+		xtest.imp = imp
+		from = xtest
+	}
+	readFile := func(name string) ([]byte, error) {
+		if name == filename {
+			return filesemi, nil
+		}
+		return c.readFile(name)
+	}
 	cfg := types.Config{
-		Importer: c.Importer,
+		Importer: withCgo(from, pkg, fset, files, readFile, c.buildContext()),
 		Error:    func(err error) {},
 	}
-	pkg, _ := cfg.Check("", fset, files, nil)
+	info := &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Defs:  make(map[*ast.Ident]types.Object),
+	}
+	types.NewChecker(&cfg, fset, pkg, info).Files(files)
+
+	if imp.err != nil {
+		return fset, pos, pkg, fileAST, info, imp.err
+	}
+	return fset, pos, pkg, fileAST, info, nil
+}
+
+// evalOperand returns the type and value of expr, the operand of the
+// selector at pos, which ends at end. Expressions that types.Eval
+// rejects, like ones using cgo names, fall back to what the type
+// checker recorded for the operand.
+func evalOperand(fset *token.FileSet, pkg *types.Package, pos token.Pos, info *types.Info, expr string, end token.Pos) types.TypeAndValue {
+	tv, err := types.Eval(fset, pkg, pos, expr)
+	if err == nil {
+		return tv
+	}
+	var outer ast.Expr
+	for e, etv := range info.Types {
+		if e.End() == end && (outer == nil || e.Pos() < outer.Pos()) {
+			outer, tv = e, etv
+		}
+	}
+	return tv
+}
+
+// operandEnd returns the end of the operand of the selector whose
+// partial name ends at the cursor, which is at pos.
+func operandEnd(data []byte, cursor int, partial string, pos token.Pos) token.Pos {
+	const space = " \t\r\n"
+	off := len(bytes.TrimRight(data[:cursor-len(partial)], space))
+	if off > 0 && data[off-1] == '.' {
+		off = len(bytes.TrimRight(data[:off-1], space))
+	}
+	return pos - token.Pos(cursor-off)
+}
+
+// parseOtherFiles parses filenames into fset, skipping the ones
+// that can't be parsed at all.
+func (c *Config) parseOtherFiles(fset *token.FileSet, filenames []string) []*ast.File {
+	var files []*ast.File
+	for _, filename := range filenames {
+		file, err := c.parseOtherFile(fset, filename)
+		if err != nil {
+			c.logParseError("Error parsing other file", err)
+		}
+		if file != nil {
+			files = append(files, file)
+		}
+	}
+	return files
+}
 
-	return fset, pos, pkg
+// parseOtherFile parses filename into fset with all function bodies
+// cleared, reusing the parse cache if there is one.
+func (c *Config) parseOtherFile(fset *token.FileSet, filename string) (*ast.File, error) {
+	if c.ParseCache == nil {
+		return parseStripped(fset, filename, c.Overlay[filename])
+	}
+	file, tf, err := c.ParseCache.parseFile(filename, c.Overlay[filename])
+	if file != nil {
+		fset.AddExistingFiles(tf)
+	}
+	return file, err
 }
 
 func (c *Config) fieldNameCandidates(typ types.Type, b *candidateCollector) {
@@ -168,43 +345,110 @@ func (c *Config) logParseError(intro string, err error) {
 	}
 }
 
-func (c *Config) findOtherPackageFiles(filename, pkgName string) []string {
+// firstError returns the message of the first error in err.
+func firstError(err error) string {
+	if el, ok := err.(scanner.ErrorList); ok && len(el) > 0 {
+		return el[0].Error()
+	}
+	if err == nil {
+		return "missing package clause"
+	}
+	return err.Error()
+}
+
+// findOtherPackageFiles returns the files of package pkgName in the
+// directory of filename, other than filename itself. Test files are
+// included only if tests is set. A directory that doesn't exist, as
+// for a new file that's only in the overlay, has no other files on
+// disk.
+func (c *Config) findOtherPackageFiles(filename, pkgName string, tests bool) ([]string, error) {
 	if filename == "" {
-		return nil
+		return nil, nil
 	}
 
 	dir, file := filepath.Split(filename)
 	dents, err := ioutil.ReadDir(dir)
-	if err != nil {
-		panic(err)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	onDisk := make(map[string]bool)
+	var names []string
+	for _, dent := range dents {
+		onDisk[dent.Name()] = true
+		names = append(names, dent.Name())
+	}
+	for name := range c.Overlay {
+		if d, base := filepath.Split(name); d == dir && !onDisk[base] {
+			names = append(names, base)
+		}
+	}
+	sort.Strings(names)
+
+	bctx := *c.buildContext()
+	if c.Overlay != nil {
+		bctx.OpenFile = c.openFile
 	}
-	isTestFile := strings.HasSuffix(file, "_test.go")
 
-	// TODO(mdempsky): Use go/build.(*Context).MatchFile or
-	// something to properly handle build tags?
 	var out []string
-	for _, dent := range dents {
-		name := dent.Name()
-		if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+	for _, name := range names {
+		if name == file || !strings.HasSuffix(name, ".go") {
 			continue
 		}
-		if name == file || !strings.HasSuffix(name, ".go") {
+		if !tests && strings.HasSuffix(name, "_test.go") {
 			continue
 		}
-		if !isTestFile && strings.HasSuffix(name, "_test.go") {
+
+		// MatchFile also skips files starting with "." or "_".
+		if match, err := bctx.MatchFile(dir, name); err != nil || !match {
 			continue
 		}
 
 		abspath := filepath.Join(dir, name)
-		if pkgNameFor(abspath) == pkgName {
+		if c.pkgNameFor(abspath) == pkgName {
 			out = append(out, abspath)
 		}
 	}
 
-	return out
+	return out, nil
+}
+
+func (c *Config) buildContext() *build.Context {
+	if c.BuildContext != nil {
+		return c.BuildContext
+	}
+	return &build.Default
+}
+
+// readFile returns the contents of filename, taking them from
+// c.Overlay if they're there.
+func (c *Config) readFile(filename string) ([]byte, error) {
+	if src, ok := c.Overlay[filename]; ok {
+		return src, nil
+	}
+	return ioutil.ReadFile(filename)
 }
 
-func pkgNameFor(filename string) string {
-	file, _ := parser.ParseFile(token.NewFileSet(), filename, nil, parser.PackageClauseOnly)
+func (c *Config) openFile(filename string) (io.ReadCloser, error) {
+	src, err := c.readFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(src)), nil
+}
+
+func (c *Config) pkgNameFor(filename string) string {
+	if c.ParseCache != nil {
+		// The whole file is needed anyway if it turns out
+		// to belong to the package.
+		if file, _, _ := c.ParseCache.parseFile(filename, c.Overlay[filename]); file != nil && file.Name != nil {
+			return file.Name.Name
+		}
+		return ""
+	}
+	src, err := c.readFile(filename)
+	if err != nil {
+		return ""
+	}
+	file, _ := parser.ParseFile(token.NewFileSet(), filename, src, parser.PackageClauseOnly)
 	return file.Name.Name
 }
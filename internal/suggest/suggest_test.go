@@ -3,10 +3,13 @@ package suggest_test
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"go/build"
 	"go/importer"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 
@@ -50,8 +53,12 @@ func testRegress(t *testing.T, testDir string) {
 	}
 	data = append(data[:cursor], data[cursor+1:]...)
 
+	// Copy build.Default so that config.json can override parts
+	// of it.
+	bctx := build.Default
 	cfg := suggest.Config{
-		Importer: importer.Default(),
+		Importer:     importer.Default(),
+		BuildContext: &bctx,
 	}
 	if testing.Verbose() {
 		cfg.Logf = t.Logf
@@ -65,10 +72,10 @@ func testRegress(t *testing.T, testDir string) {
 		t.Errorf("Open failed: %v", err)
 		return
 	}
-	candidates, prefixLen := cfg.Suggest(filename, data, cursor)
+	candidates, prefixLen, _ := cfg.Suggest(filename, data, cursor)
 
 	var out bytes.Buffer
-	suggest.NiceFormat(&out, candidates, prefixLen)
+	suggest.NiceFormat(&out, candidates, prefixLen, nil, false)
 
 	want, _ := ioutil.ReadFile(filepath.Join(testDir, "out.expected"))
 	if got := out.Bytes(); !bytes.Equal(got, want) {
@@ -76,3 +83,226 @@ func testRegress(t *testing.T, testDir string) {
 		return
 	}
 }
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		data   string
+		cursor int
+		kind   string
+	}{
+		{"package p\n", 100, suggest.CursorError},
+		{"pa", 2, suggest.ParseError},
+		{"package p\nimport \"no/such/pkg\"\nvar _ = pkg.", 43, suggest.ImportError},
+	}
+	for _, test := range tests {
+		cfg := suggest.Config{
+			Importer: importer.Default(),
+		}
+		filename := filepath.Join(t.TempDir(), "x.go")
+		candidates, _, err := cfg.Suggest(filename, []byte(test.data), test.cursor)
+		if candidates != nil {
+			t.Errorf("%q: got candidates %v, want none", test.data, candidates)
+		}
+		serr, ok := err.(*suggest.Error)
+		if !ok || serr.Kind != test.kind {
+			t.Errorf("%q: got error %v, want %s error", test.data, err, test.kind)
+		}
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.go"), []byte("package p\n\nfunc OnDisk() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	overlay := map[string][]byte{
+		filepath.Join(dir, "a.go"): []byte("package p\n\nfunc Unsaved() {}\n"),
+		filepath.Join(dir, "b.go"): []byte("package p\n\nfunc New() {}\n"),
+	}
+	data := []byte("package p\n\nfunc f() {\n\t\n}\n")
+	cursor := bytes.Index(data, []byte("\t\n")) + 1
+
+	tests := []struct {
+		overlay map[string][]byte
+		want    string
+	}{
+		{overlay, "[New Unsaved f]"},
+		{nil, "[OnDisk f]"},
+		{overlay, "[New Unsaved f]"},
+	}
+	for _, parseCache := range []*suggest.ParseCache{nil, suggest.NewParseCache()} {
+		for _, test := range tests {
+			cfg := suggest.Config{
+				Importer:   importer.Default(),
+				ParseCache: parseCache,
+				Overlay:    test.overlay,
+			}
+			candidates, _, err := cfg.Suggest(filepath.Join(dir, "x.go"), data, cursor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, c := range candidates {
+				names = append(names, c.Name)
+			}
+			if got := fmt.Sprint(names); got != test.want {
+				t.Errorf("cache %v, overlay %v: got %s, want %s", parseCache != nil, test.overlay != nil, got, test.want)
+			}
+		}
+	}
+}
+
+func TestMissingDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.go"), []byte("package p\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("package p\n\nfunc f() {\n\t\n}\n")
+	cursor := bytes.Index(data, []byte("\t\n")) + 1
+
+	// A new file's directory may not have been created yet.
+	newDir := filepath.Join(dir, "new")
+	cfg := suggest.Config{
+		Importer: importer.Default(),
+		Overlay: map[string][]byte{
+			filepath.Join(newDir, "b.go"): []byte("package p\n\nfunc New() {}\n"),
+		},
+	}
+	candidates, _, err := cfg.Suggest(filepath.Join(newDir, "x.go"), data, cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, c := range candidates {
+		names = append(names, c.Name)
+	}
+	if got, want := fmt.Sprint(names), "[New f]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// Other failures to read the directory are reported.
+	candidates, _, err = cfg.Suggest(filepath.Join(dir, "a.go", "x.go"), data, cursor)
+	if candidates != nil {
+		t.Errorf("got candidates %v, want none", candidates)
+	}
+	if serr, ok := err.(*suggest.Error); !ok || serr.Kind != suggest.ReadError {
+		t.Errorf("got error %v, want %s error", err, suggest.ReadError)
+	}
+}
+
+func TestUnimported(t *testing.T) {
+	tests := []struct {
+		data string // with @ at the cursor
+		want string // with the import added
+	}{
+		{
+			"package p\n\nfunc f() { strings.TrimSp@ }\n",
+			"package p\n\nimport \"strings\"\n\nfunc f() { strings.TrimSp }\n",
+		},
+		{
+			"package p\n\nimport \"fmt\"\n\nfunc f() { fmt.Print(strings.TrimSp@) }\n",
+			"package p\n\nimport \"fmt\"\nimport \"strings\"\n\nfunc f() { fmt.Print(strings.TrimSp) }\n",
+		},
+		{
+			"package p\n\nimport (\n\t\"fmt\"\n\t\"unicode\"\n)\n\nfunc f() { fmt.Print(unicode.IsSpace, strings.TrimSp@) }\n",
+			"package p\n\nimport (\n\t\"fmt\"\n\t\"strings\"\n\t\"unicode\"\n)\n\nfunc f() { fmt.Print(unicode.IsSpace, strings.TrimSp) }\n",
+		},
+	}
+	for _, test := range tests {
+		cursor := strings.IndexByte(test.data, '@')
+		data := []byte(test.data[:cursor] + test.data[cursor+1:])
+		cfg := suggest.Config{
+			Importer: importer.Default(),
+			FindPackage: func(name, dir string) string {
+				if name == "strings" {
+					return "strings"
+				}
+				return ""
+			},
+		}
+		candidates, _, err := cfg.Suggest(filepath.Join(t.TempDir(), "x.go"), data, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(candidates) != 1 || candidates[0].Name != "TrimSpace" || len(candidates[0].Edits) != 1 {
+			t.Fatalf("%q: got %+v, want TrimSpace with one edit", test.data, candidates)
+		}
+		e := candidates[0].Edits[0]
+		got := string(data[:e.Offset]) + e.Text + string(data[e.Offset+e.Length:])
+		if got != test.want {
+			t.Errorf("%q: got\n%s\nwant\n%s", test.data, got, test.want)
+		}
+	}
+}
+
+func TestImportPaths(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a/a.go":   "// Package a does A.\npackage a\n",
+		"a/b/b.go": "package bee\n",
+		"ab/ab.go": "package ab\n",
+		"cgo/c.go": "// +build ignore\n\npackage cgo\n",
+	}
+	paths := make(map[string]string)
+	for name, src := range files {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		dir := filepath.Dir(name)
+		rel, _ := filepath.Rel(root, dir)
+		paths[filepath.ToSlash(rel)] = dir
+	}
+
+	tests := []struct {
+		data string // with @ at the cursor
+		want string
+		n    int
+		doc  string // of the first candidate
+	}{
+		{"package p\n\nimport \"a@\"\n", "import a a, import a/, import ab ab", 1, "Package a does A."},
+		{"package p\n\nimport \"a/@\"\n", "import b bee", 0, ""},
+		{"package p\n\nimport (\n\tx \"a/@\n)\n", "import b bee", 0, ""},
+		{"package p\n\nimport \"@c\"\n", "import a a, import a/, import ab ab", 0, "Package a does A."},
+	}
+	for _, test := range tests {
+		cursor := strings.IndexByte(test.data, '@')
+		data := []byte(test.data[:cursor] + test.data[cursor+1:])
+		cfg := suggest.Config{
+			ImportPaths: func(dir string) map[string]string { return paths },
+		}
+		candidates, n, err := cfg.Suggest(filepath.Join(root, "x.go"), data, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range candidates {
+			got = append(got, c.String())
+		}
+		if strings.Join(got, ", ") != test.want || n != test.n {
+			t.Errorf("%q: got %q, %d, want %q, %d", test.data, got, n, test.want, test.n)
+		} else if candidates[0].Doc != test.doc {
+			t.Errorf("%q: got doc %q, want %q", test.data, candidates[0].Doc, test.doc)
+		}
+	}
+
+	// PackageDoc is only asked about the packages proposed.
+	var asked []string
+	cfg := suggest.Config{
+		ImportPaths: func(dir string) map[string]string { return paths },
+		PackageDoc: func(dir string) (string, string) {
+			rel, _ := filepath.Rel(root, dir)
+			asked = append(asked, filepath.ToSlash(rel))
+			return "pkg", ""
+		},
+	}
+	data := "package p\n\nimport \"a\"\n"
+	candidates, _, _ := cfg.Suggest(filepath.Join(root, "x.go"), []byte(data), strings.Index(data, `"a"`)+2)
+	sort.Strings(asked)
+	if got := strings.Join(asked, ", "); got != "a, ab" || len(candidates) != 3 || candidates[0].Type != "pkg" {
+		t.Errorf("asked for %q, got %v", got, candidates)
+	}
+}
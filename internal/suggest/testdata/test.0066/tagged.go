@@ -0,0 +1,5 @@
+// +build mytag
+
+package main
+
+func tagged() {}
@@ -0,0 +1,5 @@
+//go:build !mytag
+
+package main
+
+func untagged() {}
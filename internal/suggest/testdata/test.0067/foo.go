@@ -0,0 +1,5 @@
+package foo
+
+func Exported() {}
+
+func internal() int { return 0 }
@@ -0,0 +1,112 @@
+package suggest
+
+import (
+	"go/ast"
+	"go/build"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// An xtestImporter imports packages for an external test package
+// (package foo_test). Like go test, it type-checks the package under
+// test from source together with its in-package test files, so that
+// names exported by files like export_test.go are visible.
+type xtestImporter struct {
+	imp   types.ImporterFrom
+	c     *Config
+	fset  *token.FileSet
+	paths []string    // possible import paths of the package under test
+	files []*ast.File // files of the package under test
+	pkg   *types.Package
+}
+
+// newXTestImporter parses the files of package pkgName, which is
+// under test by the external test package in filename, into fset.
+// It must be called before the file being completed is parsed.
+func (c *Config) newXTestImporter(fset *token.FileSet, filename, pkgName string) (*xtestImporter, error) {
+	names, err := c.findOtherPackageFiles(filename, pkgName, true)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(filename)
+	return &xtestImporter{
+		c:     c,
+		fset:  fset,
+		paths: importPaths(c.buildContext(), dir),
+		files: c.parseOtherFiles(fset, names),
+	}, nil
+}
+
+func (x *xtestImporter) Import(path string) (*types.Package, error) {
+	return x.ImportFrom(path, "", 0)
+}
+
+func (x *xtestImporter) ImportFrom(path, srcDir string, mode types.ImportMode) (*types.Package, error) {
+	if !x.underTest(path) {
+		return x.imp.ImportFrom(path, srcDir, mode)
+	}
+	if x.pkg == nil {
+		x.pkg = types.NewPackage(path, "")
+		cfg := types.Config{
+			Importer: withCgo(x.imp, x.pkg, x.fset, x.files, x.c.readFile, x.c.buildContext()),
+			Error:    func(err error) {},
+		}
+		types.NewChecker(&cfg, x.fset, x.pkg, nil).Files(x.files)
+	}
+	return x.pkg, nil
+}
+
+// underTest reports whether path is the import path of the package
+// under test.
+func (x *xtestImporter) underTest(path string) bool {
+	if len(x.files) == 0 {
+		return false
+	}
+	for _, p := range x.paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// importPaths returns the import paths the package in dir may have:
+// the one implied by the enclosing go.mod file, if any, and the one
+// implied by GOPATH.
+func importPaths(bctx *build.Context, dir string) []string {
+	var paths []string
+	for d := dir; ; {
+		if data, err := ioutil.ReadFile(filepath.Join(d, "go.mod")); err == nil {
+			if mod := modulePath(data); mod != "" {
+				rel, _ := filepath.Rel(d, dir)
+				paths = append(paths, path.Join(mod, filepath.ToSlash(rel)))
+			}
+			break
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			break
+		}
+		d = parent
+	}
+	if bp, err := bctx.ImportDir(dir, build.FindOnly); err == nil && !build.IsLocalImport(bp.ImportPath) {
+		paths = append(paths, bp.ImportPath)
+	}
+	return paths
+}
+
+// modulePath returns the module path declared in the go.mod file
+// contents data, or "" if there isn't one.
+func modulePath(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "module" {
+			return strings.Trim(fields[1], "\"`")
+		}
+	}
+	return ""
+}
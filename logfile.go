@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxLogSize is the size at which the server's log file is rotated.
+const maxLogSize = 10 << 20
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = [...]string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return levelNames[l]
+}
+
+// A serverLog writes leveled records, either as text or as one JSON
+// object per line. Each record has a message and a list of
+// alternating keys and values. A nil *serverLog discards everything.
+type serverLog struct {
+	mu   sync.Mutex
+	w    io.Writer
+	json bool
+	min  logLevel
+}
+
+// newServerLog returns the log described by the -log, -log-format
+// and -debug flags.
+func newServerLog() (*serverLog, error) {
+	l := &serverLog{w: os.Stderr, min: levelInfo}
+	switch *g_log_format {
+	case "text":
+	case "json":
+		l.json = true
+	default:
+		return nil, fmt.Errorf("unknown log format %q", *g_log_format)
+	}
+	if *g_debug {
+		l.min = levelDebug
+	}
+	if *g_log != "" {
+		f, err := openRotatingFile(*g_log, maxLogSize)
+		if err != nil {
+			return nil, err
+		}
+		l.w = f
+	}
+	return l, nil
+}
+
+func (l *serverLog) Debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l *serverLog) Info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l *serverLog) Warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l *serverLog) Error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+func (l *serverLog) log(level logLevel, msg string, kv []interface{}) {
+	if l == nil || level < l.min {
+		return
+	}
+
+	now := time.Now().Format("2006-01-02T15:04:05.000Z07:00")
+	var buf bytes.Buffer
+	if l.json {
+		buf.WriteString(`{"time":`)
+		writeJSON(&buf, now)
+		buf.WriteString(`,"level":`)
+		writeJSON(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSON(&buf, msg)
+		for i := 0; i+1 < len(kv); i += 2 {
+			buf.WriteString(",")
+			writeJSON(&buf, fmt.Sprint(kv[i]))
+			buf.WriteString(":")
+			writeJSON(&buf, logValue(kv[i+1]))
+		}
+		buf.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&buf, "%s %-5s %s", now, strings.ToUpper(level.String()), msg)
+		for i := 0; i+1 < len(kv); i += 2 {
+			fmt.Fprintf(&buf, " %v=%s", kv[i], quoteIfNeeded(fmt.Sprint(logValue(kv[i+1]))))
+		}
+		buf.WriteString("\n")
+	}
+
+	l.mu.Lock()
+	l.w.Write(buf.Bytes())
+	l.mu.Unlock()
+}
+
+// logValue converts v into a form that reads well in both formats.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+func quoteIfNeeded(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// A logWriter turns each write, such as one made by the standard
+// log package, into a record of the given level.
+type logWriter struct {
+	l     *serverLog
+	level logLevel
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.l.log(w.level, strings.TrimRight(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+// A rotatingFile is an append-only file that's renamed to path+".1",
+// replacing any earlier one, once it grows past maxSize.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	f       *os.File
+	size    int64
+
+	// limit is the size past which the file is rotated next.
+	// It's raised when rotating fails.
+	limit int64
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.limit = f, fi.Size(), r.maxSize
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.size > 0 && r.size+int64(len(p)) > r.limit {
+		r.f.Close()
+		renameErr := os.Rename(r.path, r.path+".1")
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+		if renameErr != nil {
+			// We reopened the same file. Note why it keeps
+			// growing, and don't try again until it has grown
+			// by another maxSize.
+			n, _ := fmt.Fprintf(r.f, "log rotation failed: %v\n", renameErr)
+			r.size += int64(n)
+			r.limit = r.size + r.maxSize
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gocode.log")
+	read := func(name string) string {
+		t.Helper()
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	write := func(r *rotatingFile, s string) {
+		t.Helper()
+		if n, err := r.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+
+	r, err := openRotatingFile(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(r, "aaaa\n")
+	write(r, "bbbb\n")
+	r.f.Close()
+
+	// Reopening continues where the file left off, so the next
+	// write goes past maxSize and rolls the file over.
+	r, err = openRotatingFile(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.size != 10 {
+		t.Errorf("reopened file has size %d, want 10", r.size)
+	}
+	write(r, "cccc\n")
+	if got := read(path + ".1"); got != "aaaa\nbbbb\n" {
+		t.Errorf("rolled over file holds %q", got)
+	}
+	if got := read(path); got != "cccc\n" || r.size != 5 {
+		t.Errorf("new file holds %q with size %d", got, r.size)
+	}
+
+	// Rolling over again replaces the older file, and a write
+	// bigger than maxSize still goes into a file of its own.
+	write(r, "dddddddddddd\n")
+	write(r, "e\n")
+	r.f.Close()
+	if got := read(path + ".1"); got != "dddddddddddd\n" {
+		t.Errorf("rolled over file holds %q", got)
+	}
+	if got := read(path); got != "e\n" {
+		t.Errorf("new file holds %q", got)
+	}
+}
+
+func TestRotatingFileRenameError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gocode.log")
+	// A non-empty directory can't be replaced by a file.
+	if err := os.MkdirAll(filepath.Join(path+".1", "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := openRotatingFile(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.f.Close()
+	for _, s := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n"} {
+		if n, err := r.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rotation is only attempted once, and the records are kept
+	// in the current file.
+	got := string(data)
+	if strings.Count(got, "log rotation failed") != 1 || !strings.HasPrefix(got, "aaaa\nbbbb\n") || !strings.HasSuffix(got, "cccc\ndddd\n") {
+		t.Errorf("log holds %q", got)
+	}
+}
+
+func TestServerLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := &serverLog{w: &buf, min: levelInfo}
+	l.Debug("hidden")
+	l.Info("request", "file", "a b.go", "cursor", 12, "err", errors.New("oops"))
+	l.Warn("slow")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d records, want 2:\n%s", len(lines), buf.String())
+	}
+	// Skip the timestamp.
+	if got, want := lines[0][strings.IndexByte(lines[0], ' ')+1:], `INFO  request file="a b.go" cursor=12 err=oops`; got != want {
+		t.Errorf("text record = %q, want %q", got, want)
+	}
+	if got, want := lines[1][strings.IndexByte(lines[1], ' ')+1:], "WARN  slow"; got != want {
+		t.Errorf("text record = %q, want %q", got, want)
+	}
+
+	buf.Reset()
+	l = &serverLog{w: &buf, json: true, min: levelDebug}
+	l.Debug("request", "file", "a.go", "cursor", 12, "err", errors.New("oops"))
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("bad JSON record %q: %v", buf.String(), err)
+	}
+	if rec["time"] == nil {
+		t.Errorf("JSON record has no time")
+	}
+	delete(rec, "time")
+	want := map[string]interface{}{"level": "debug", "msg": "request", "file": "a.go", "cursor": 12.0, "err": "oops"}
+	if len(rec) != len(want) {
+		t.Errorf("JSON record = %v, want %v", rec, want)
+	}
+	for k, v := range want {
+		if rec[k] != v {
+			t.Errorf("JSON record has %s = %v, want %v", k, rec[k], v)
+		}
+	}
+
+	// A nil log discards everything.
+	var nilLog *serverLog
+	nilLog.Error("ignored")
+}
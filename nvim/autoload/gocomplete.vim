@@ -79,6 +79,18 @@ fu! gocomplete#Complete(findstart, base)
 	"findstart = 1 when we need to get the text length
 	if a:findstart == 1
 		execute "silent let g:gocomplete_completions = " . s:gocodeAutocomplete()
+		if len(g:gocomplete_completions) > 2
+			let extra = g:gocomplete_completions[2]
+			if has_key(extra, 'error')
+				echohl ErrorMsg
+				echom printf('gocode: %s error: %s', extra.error.kind, extra.error.message)
+				echohl None
+			elseif has_key(extra, 'partial')
+				echohl WarningMsg
+				echom 'gocode: timed out, completions may be incomplete'
+				echohl None
+			endif
+		endif
 		return col('.') - g:gocomplete_completions[0] - 1
 	"findstart = 0 when we need to return the list of completions
 	else
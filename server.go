@@ -3,14 +3,18 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"go/importer"
 	"go/types"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
 	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/mdempsky/gocode/internal/gbimporter"
@@ -23,19 +27,44 @@ func doServer() {
 		addr = getSocketPath()
 	}
 
+	logger, err := newServerLog()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	lis, err := net.Listen(*g_sock, addr)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	sigs := make(chan os.Signal)
+	// Send what's printed with the log package to the server log
+	// too. That's the -debug output, or else failures reported by
+	// net/rpc and the server itself.
+	log.SetFlags(0)
+	if *g_debug {
+		log.SetOutput(logWriter{logger, levelDebug})
+	} else {
+		log.SetOutput(logWriter{logger, levelError})
+	}
+
+	s := newServer()
+	s.addr = *g_sock + ":" + addr
+	s.log = logger
+	s.log.Info("server started", "pid", os.Getpid(), "address", s.addr, "go_version", runtime.Version())
+
+	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt)
 	go func() {
-		<-sigs
+		sig := <-sigs
+		s.log.Info("server stopping", "reason", sig)
 		exitServer()
 	}()
 
-	if err = rpc.Register(&Server{}); err != nil {
+	if *g_idle > 0 {
+		go s.watchIdle(*g_idle)
+	}
+
+	if err = rpc.Register(s); err != nil {
 		log.Fatal(err)
 	}
 	rpc.Accept(lis)
@@ -49,6 +78,94 @@ func exitServer() {
 }
 
 type Server struct {
+	// imports and files cache imported packages and parsed
+	// sibling files across requests.
+	imports *gbimporter.Cache
+	files   *suggest.ParseCache
+
+	started time.Time
+	addr    string
+
+	// log is nil when the server runs inside the client.
+	log *serverLog
+
+	mu          sync.Mutex
+	active      int       // number of requests in progress
+	lastRequest time.Time // when the last request finished
+	requests    int64     // number of completion requests served
+	latencies   []time.Duration
+}
+
+// maxLatencies is the number of recent completion latencies kept
+// for computing percentiles.
+const maxLatencies = 1000
+
+// slowRequest is the latency above which completion requests are
+// logged as warnings.
+const slowRequest = time.Second
+
+func newServer() *Server {
+	now := time.Now()
+	return &Server{
+		imports:     gbimporter.NewCache(),
+		files:       suggest.NewParseCache(),
+		started:     now,
+		addr:        "none",
+		lastRequest: now,
+	}
+}
+
+func (s *Server) beginRequest() {
+	s.mu.Lock()
+	s.active++
+	s.mu.Unlock()
+}
+
+func (s *Server) endRequest() {
+	s.mu.Lock()
+	s.active--
+	s.lastRequest = time.Now()
+	s.mu.Unlock()
+}
+
+// recordLatency records the duration of a completion request.
+func (s *Server) recordLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.latencies) < maxLatencies {
+		s.latencies = append(s.latencies, d)
+	} else {
+		s.latencies[s.requests%maxLatencies] = d
+	}
+	s.requests++
+}
+
+// watchIdle shuts the server down once it has gone idle long
+// without serving any requests.
+func (s *Server) watchIdle(idle time.Duration) {
+	for {
+		wait, stop := s.idleWait(idle, time.Now())
+		if stop {
+			s.log.Info("server stopping", "reason", "idle for "+idle.String())
+			exitServer()
+		}
+		time.Sleep(wait)
+	}
+}
+
+// idleWait reports whether, at now, the server has been idle long
+// enough to stop, and if not, how long to wait before checking again.
+// A server with requests in progress is never idle.
+func (s *Server) idleWait(idle time.Duration, now time.Time) (wait time.Duration, stop bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if wait := idle - now.Sub(s.lastRequest); wait > 0 {
+		return wait, false
+	}
+	if s.active > 0 {
+		return idle, false
+	}
+	return 0, true
 }
 
 type AutoCompleteRequest struct {
@@ -56,23 +173,66 @@ type AutoCompleteRequest struct {
 	Data     []byte
 	Cursor   int
 	Context  gbimporter.PackedContext
-	Source   bool
+	Mode     gbimporter.Mode
 	Builtin  bool
+	Fuzzy    bool
+
+	// Edits is set if the client's output format can show the
+	// edits of candidates, which completing members of packages
+	// that aren't imported yet requires.
+	Edits bool
+
+	// Timeout, if positive, limits how long the server spends
+	// importing packages for this request.
+	Timeout time.Duration
+
+	// Overlay holds the contents of other unsaved files, keyed
+	// by absolute filename.
+	Overlay map[string][]byte
+
+	// BuildID and GoVersion identify the client's gocode binary.
+	// A daemon built differently doesn't serve the request.
+	BuildID   string
+	GoVersion string
 }
 
 type AutoCompleteReply struct {
 	Candidates []suggest.Candidate
 	Len        int
+
+	// Partial is set when the timeout expired before all
+	// imports were loaded, so Candidates may be incomplete.
+	Partial bool
+
+	// Error describes why no candidates were found, if known.
+	Error *suggest.Error
+
+	// BuildID and GoVersion identify the daemon's gocode binary,
+	// so clients can replace a stale daemon. Daemons too old to
+	// set them leave them empty.
+	BuildID   string
+	GoVersion string
 }
 
 func (s *Server) AutoComplete(req *AutoCompleteRequest, res *AutoCompleteReply) error {
+	res.BuildID, res.GoVersion = buildID(), runtime.Version()
+	if req.BuildID != "" && !sameBuild(req.BuildID, req.GoVersion) {
+		// The client will restart us, so don't bother.
+		return nil
+	}
+
+	s.beginRequest()
+	defer s.endRequest()
 	defer func() {
 		if err := recover(); err != nil {
-			fmt.Printf("panic: %s\n\n", err)
-			debug.PrintStack()
+			stack := debug.Stack()
+			s.log.Error("panic", "file", req.Filename, "cursor", req.Cursor, "err", err, "stack", string(stack))
 
-			res.Candidates = []suggest.Candidate{
-				{Class: "PANIC", Name: "PANIC", Type: "PANIC"},
+			res.Candidates = nil
+			res.Error = &suggest.Error{
+				Kind:    suggest.PanicError,
+				Message: fmt.Sprint(err),
+				Stack:   string(stack),
 			}
 		}
 	}()
@@ -88,23 +248,39 @@ func (s *Server) AutoComplete(req *AutoCompleteRequest, res *AutoCompleteReply)
 		log.Println("-------------------------------------------------------")
 	}
 	now := time.Now()
-	var underlying types.ImporterFrom
-	if req.Source {
-		underlying = importer.For("source", nil).(types.ImporterFrom)
-	} else {
-		underlying = importer.Default().(types.ImporterFrom)
+	imp := s.imports.Importer(&req.Context, req.Filename, req.Mode)
+	if req.Timeout > 0 {
+		imp.SetDeadline(now.Add(req.Timeout))
 	}
+	imp.SetOverlay(req.Overlay)
 	cfg := suggest.Config{
-		Importer: gbimporter.New(&req.Context, req.Filename, underlying),
+		Importer: loggingImporter{imp, s.log},
 		Builtin:  req.Builtin,
+		Fuzzy:    req.Fuzzy,
+
+		ParseCache:   s.files,
+		BuildContext: req.Context.BuildContext(),
+		Overlay:      req.Overlay,
+		ImportPaths:  imp.ImportPaths,
+		PackageDoc:   imp.PackageDoc,
+	}
+	if req.Edits {
+		cfg.FindPackage = imp.FindPackage
 	}
 	if *g_debug {
 		cfg.Logf = log.Printf
 	}
-	candidates, d := cfg.Suggest(req.Filename, req.Data, req.Cursor)
+	candidates, d, err := cfg.Suggest(req.Filename, req.Data, req.Cursor)
 	elapsed := time.Since(now)
+	s.recordLatency(elapsed)
 	if *g_debug {
 		log.Printf("Elapsed duration: %v\n", elapsed)
+		if imp.Expired() {
+			log.Printf("Timed out after %v, results are partial\n", req.Timeout)
+		}
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+		}
 		log.Printf("Offset: %d\n", res.Len)
 		log.Printf("Number of candidates found: %d\n", len(candidates))
 		log.Printf("Candidates are:\n")
@@ -114,16 +290,142 @@ func (s *Server) AutoComplete(req *AutoCompleteRequest, res *AutoCompleteReply)
 		log.Println("=======================================================")
 	}
 	res.Candidates, res.Len = candidates, d
+	res.Partial = imp.Expired()
+	if err, ok := err.(*suggest.Error); ok {
+		res.Error = err
+	}
+
+	kv := []interface{}{"file", req.Filename, "cursor", req.Cursor, "candidates", len(candidates), "elapsed", elapsed}
+	if res.Partial {
+		kv = append(kv, "partial", true)
+	}
+	if res.Error != nil {
+		kv = append(kv, "err", res.Error)
+	}
+	if elapsed >= slowRequest {
+		s.log.Warn("slow request", kv...)
+	} else {
+		s.log.Info("request", kv...)
+	}
 	return nil
 }
 
+// loggingImporter logs the imports that fail while serving a
+// request.
+type loggingImporter struct {
+	*gbimporter.Importer
+	log *serverLog
+}
+
+func (i loggingImporter) Import(path string) (*types.Package, error) {
+	return i.ImportFrom(path, "", 0)
+}
+
+func (i loggingImporter) ImportFrom(path, srcDir string, mode types.ImportMode) (*types.Package, error) {
+	pkg, err := i.Importer.ImportFrom(path, srcDir, mode)
+	if err != nil && err != gbimporter.ErrDeadline {
+		i.log.Warn("import failed", "path", path, "dir", srcDir, "err", err)
+	}
+	return pkg, err
+}
+
 type ExitRequest struct{}
 type ExitReply struct{}
 
 func (s *Server) Exit(req *ExitRequest, res *ExitReply) error {
+	s.log.Info("server stopping", "reason", "exit requested")
 	go func() {
 		time.Sleep(time.Second)
 		exitServer()
 	}()
 	return nil
 }
+
+type StatusRequest struct{}
+type StatusReply struct {
+	PID       int           `json:"pid"`
+	Address   string        `json:"address"`
+	GoVersion string        `json:"go_version"`
+	BuildID   string        `json:"build_id"`
+	Uptime    time.Duration `json:"uptime_ns"`
+	Requests  int64         `json:"requests"`
+
+	CachedPackages int `json:"cached_packages"`
+	CachedFiles    int `json:"cached_files"`
+
+	HeapAlloc uint64 `json:"heap_alloc"`
+	Sys       uint64 `json:"sys"`
+
+	// Completion latency percentiles over recent requests.
+	P50 time.Duration `json:"p50_ns"`
+	P95 time.Duration `json:"p95_ns"`
+	P99 time.Duration `json:"p99_ns"`
+}
+
+func (s *Server) Status(req *StatusRequest, res *StatusReply) error {
+	res.PID = os.Getpid()
+	res.Address = s.addr
+	res.GoVersion = runtime.Version()
+	res.BuildID = buildID()
+	res.Uptime = time.Since(s.started)
+	res.CachedPackages = s.imports.Len()
+	res.CachedFiles = s.files.Len()
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	res.HeapAlloc = ms.HeapAlloc
+	res.Sys = ms.Sys
+
+	s.mu.Lock()
+	res.Requests = s.requests
+	latencies := append([]time.Duration(nil), s.latencies...)
+	s.mu.Unlock()
+
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		res.P50 = percentile(latencies, 50)
+		res.P95 = percentile(latencies, 95)
+		res.P99 = percentile(latencies, 99)
+	}
+	return nil
+}
+
+type DropCacheRequest struct {
+	Paths []string
+
+	// Context and Dir, the client's working directory, determine
+	// the source directories that Paths refer to.
+	Context gbimporter.PackedContext
+	Dir     string
+}
+type DropCacheReply struct {
+	Packages int
+	Files    int
+}
+
+// DropCache discards cached packages and parsed files. If any import
+// paths are given, only those packages and the packages depending on
+// them are discarded.
+func (s *Server) DropCache(req *DropCacheRequest, res *DropCacheReply) error {
+	dirs := s.imports.Drop(req.Paths)
+	res.Packages = len(dirs)
+
+	// Parsed files belong to the packages being completed, which
+	// aren't cached as imports, so look up their directories too.
+	for _, path := range req.Paths {
+		dir, err := s.imports.PackageDir(&req.Context, filepath.Join(req.Dir, "x.go"), path)
+		if err == nil {
+			dirs = append(dirs, dir)
+		}
+	}
+	dropped := make(map[string]bool)
+	for _, dir := range dirs {
+		dropped[dir] = true
+	}
+	res.Files = s.files.Drop(func(dir string) bool {
+		return len(req.Paths) == 0 || dropped[dir]
+	})
+
+	s.log.Info("cache dropped", "paths", strings.Join(req.Paths, ","), "packages", res.Packages, "files", res.Files)
+	return nil
+}
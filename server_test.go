@@ -0,0 +1,121 @@
+package main
+
+import (
+	"go/build"
+	"go/importer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mdempsky/gocode/internal/gbimporter"
+	"github.com/mdempsky/gocode/internal/suggest"
+)
+
+func TestIdleWait(t *testing.T) {
+	const idle = time.Minute
+	s := newServer()
+	start := s.lastRequest
+
+	check := func(now time.Time, wantWait time.Duration, wantStop bool) {
+		t.Helper()
+		wait, stop := s.idleWait(idle, now)
+		if wait != wantWait || stop != wantStop {
+			t.Errorf("idleWait at +%v = %v, %v; want %v, %v", now.Sub(start), wait, stop, wantWait, wantStop)
+		}
+	}
+
+	// A fresh server waits out the rest of the idle period.
+	check(start, idle, false)
+	check(start.Add(20*time.Second), 40*time.Second, false)
+	check(start.Add(idle), 0, true)
+
+	// A request in progress keeps the server alive past the idle
+	// period, and finishing it restarts the period.
+	s.beginRequest()
+	check(start.Add(2*idle), idle, false)
+	s.endRequest()
+	end := s.lastRequest
+	check(end.Add(idle/2), idle/2, false)
+	check(end.Add(idle), 0, true)
+}
+
+func TestDropCache(t *testing.T) {
+	gopath := t.TempDir()
+	files := map[string]string{
+		"a/a.go":               "package a\n",
+		"a/b.go":               "package a\n",
+		"x/example.com/a/a.go": "package a\n",
+		"y/y.go":               "package y\n",
+	}
+	s := newServer()
+	for name, src := range files {
+		name = filepath.Join(gopath, "src", "example.com", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Cache the file like a completion request in its
+		// package would.
+		data := src + "var _ = "
+		cfg := suggest.Config{ParseCache: s.files, Importer: importer.Default()}
+		cfg.Suggest(filepath.Join(filepath.Dir(name), "cursor.go"), []byte(data), len(data))
+	}
+	if n := s.files.Len(); n != len(files) {
+		t.Fatalf("%d files cached, want %d", n, len(files))
+	}
+
+	req := &DropCacheRequest{
+		Paths:   []string{"example.com/a"},
+		Context: gbimporter.PackContext(&build.Default),
+		Dir:     gopath,
+	}
+	req.Context.GOPATH = gopath
+	req.Context.GO111MODULE = "off"
+	var res DropCacheReply
+	if err := s.DropCache(req, &res); err != nil {
+		t.Fatal(err)
+	}
+	// Only example.com/a's files are dropped, not those of
+	// example.com/x/example.com/a.
+	if res.Files != 2 || s.files.Len() != 2 {
+		t.Errorf("dropped %d files, leaving %d; want 2, 2", res.Files, s.files.Len())
+	}
+
+	req.Paths = nil
+	if err := s.DropCache(req, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Files != 2 || s.files.Len() != 0 {
+		t.Errorf("dropped %d files, leaving %d; want 2, 0", res.Files, s.files.Len())
+	}
+}
+
+func TestAutoCompleteEdits(t *testing.T) {
+	data := "package p\n\nfunc f() { strings.TrimSp }\n"
+	req := &AutoCompleteRequest{
+		Filename: filepath.Join(t.TempDir(), "p.go"),
+		Data:     []byte(data),
+		Cursor:   len("package p\n\nfunc f() { strings.TrimSp"),
+		Context:  gbimporter.PackContext(&build.Default),
+	}
+	req.Context.GO111MODULE = "off"
+
+	// Members of packages that aren't imported yet need an edit
+	// to import them, so they're only proposed to formats that
+	// can carry it.
+	s := newServer()
+	for _, edits := range []bool{false, true} {
+		req.Edits = edits
+		var res AutoCompleteReply
+		if err := s.AutoComplete(req, &res); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(res.Candidates) > 0; got != edits {
+			t.Errorf("with Edits = %v, got candidates %v", edits, res.Candidates)
+		}
+	}
+}
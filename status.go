@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+type statusFormatter func(w io.Writer, st *StatusReply)
+
+// statusFormatters mirrors suggest.Formatters for the status
+// command.
+var statusFormatters = map[string]statusFormatter{
+	"csv":              csvStatusFormat,
+	"csv-with-package": csvStatusFormat,
+	"emacs":            csvStatusFormat,
+	"godit":            niceStatusFormat,
+	"json":             jsonStatusFormat,
+	"nice":             niceStatusFormat,
+	"vim":              vimStatusFormat,
+}
+
+// statusFields returns the fields of st as key/value pairs, in
+// display order.
+func statusFields(st *StatusReply) [][2]string {
+	return [][2]string{
+		{"pid", fmt.Sprint(st.PID)},
+		{"address", st.Address},
+		{"go_version", st.GoVersion},
+		{"build_id", st.BuildID},
+		{"uptime", st.Uptime.Round(time.Second).String()},
+		{"requests", fmt.Sprint(st.Requests)},
+		{"cached_packages", fmt.Sprint(st.CachedPackages)},
+		{"cached_files", fmt.Sprint(st.CachedFiles)},
+		{"heap_alloc", fmt.Sprint(st.HeapAlloc)},
+		{"sys", fmt.Sprint(st.Sys)},
+		{"p50", st.P50.String()},
+		{"p95", st.P95.String()},
+		{"p99", st.P99.String()},
+	}
+}
+
+func niceStatusFormat(w io.Writer, st *StatusReply) {
+	fmt.Fprintf(w, "gocode daemon (pid %d) listening on %s\n", st.PID, st.Address)
+	fmt.Fprintf(w, "  Go version:      %s\n", st.GoVersion)
+	fmt.Fprintf(w, "  Build ID:        %s\n", st.BuildID)
+	fmt.Fprintf(w, "  Uptime:          %v\n", st.Uptime.Round(time.Second))
+	fmt.Fprintf(w, "  Requests:        %d\n", st.Requests)
+	fmt.Fprintf(w, "  Cached packages: %d\n", st.CachedPackages)
+	fmt.Fprintf(w, "  Cached files:    %d\n", st.CachedFiles)
+	fmt.Fprintf(w, "  Heap in use:     %.1f MiB\n", float64(st.HeapAlloc)/(1<<20))
+	fmt.Fprintf(w, "  Memory from OS:  %.1f MiB\n", float64(st.Sys)/(1<<20))
+	fmt.Fprintf(w, "  Latency:         p50 %v, p95 %v, p99 %v\n", st.P50, st.P95, st.P99)
+}
+
+func vimStatusFormat(w io.Writer, st *StatusReply) {
+	fmt.Fprintf(w, "{")
+	for i, f := range statusFields(st) {
+		if i != 0 {
+			fmt.Fprintf(w, ", ")
+		}
+		fmt.Fprintf(w, "'%s': '%s'", f[0], f[1])
+	}
+	fmt.Fprintf(w, "}")
+}
+
+func csvStatusFormat(w io.Writer, st *StatusReply) {
+	for _, f := range statusFields(st) {
+		fmt.Fprintf(w, "%s,,%s\n", f[0], f[1])
+	}
+}
+
+func jsonStatusFormat(w io.Writer, st *StatusReply) {
+	json.NewEncoder(w).Encode(st)
+}
+
+// percentile returns the nearest-rank pth percentile of sorted.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	return sorted[(len(sorted)*p+99)/100-1]
+}
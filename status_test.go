@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 10; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	tests := []struct {
+		sorted []time.Duration
+		p      int
+		want   time.Duration
+	}{
+		{sorted[:1], 50, 1 * time.Millisecond},
+		{sorted[:1], 99, 1 * time.Millisecond},
+		{sorted[:2], 50, 1 * time.Millisecond},
+		{sorted[:2], 51, 2 * time.Millisecond},
+		{sorted, 10, 1 * time.Millisecond},
+		{sorted, 11, 2 * time.Millisecond},
+		{sorted, 50, 5 * time.Millisecond},
+		{sorted, 95, 10 * time.Millisecond},
+		{sorted, 100, 10 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if got := percentile(test.sorted, test.p); got != test.want {
+			t.Errorf("percentile(%v, %d) = %v, want %v", test.sorted, test.p, got, test.want)
+		}
+	}
+}
+
+func TestStatusLatencies(t *testing.T) {
+	s := newServer()
+	status := func() *StatusReply {
+		t.Helper()
+		var res StatusReply
+		if err := s.Status(&StatusRequest{}, &res); err != nil {
+			t.Fatal(err)
+		}
+		return &res
+	}
+
+	if st := status(); st.Requests != 0 || st.P50 != 0 || st.P99 != 0 {
+		t.Errorf("fresh server reports %d requests, p50 %v, p99 %v", st.Requests, st.P50, st.P99)
+	}
+
+	// Record 1ms to 100ms, in shuffled order.
+	for i := 0; i < 100; i++ {
+		s.recordLatency(time.Duration(i*37%100+1) * time.Millisecond)
+	}
+	st := status()
+	if st.Requests != 100 || st.P50 != 50*time.Millisecond || st.P95 != 95*time.Millisecond || st.P99 != 99*time.Millisecond {
+		t.Errorf("got %d requests, p50 %v, p95 %v, p99 %v; want 100, 50ms, 95ms, 99ms", st.Requests, st.P50, st.P95, st.P99)
+	}
+
+	// Only the most recent maxLatencies requests count.
+	for i := 0; i < maxLatencies; i++ {
+		s.recordLatency(time.Second)
+	}
+	if len(s.latencies) != maxLatencies {
+		t.Errorf("kept %d latencies, want %d", len(s.latencies), maxLatencies)
+	}
+	st = status()
+	if st.Requests != 100+maxLatencies || st.P50 != time.Second || st.P99 != time.Second {
+		t.Errorf("got %d requests, p50 %v, p99 %v; want %d, 1s, 1s", st.Requests, st.P50, st.P99, 100+maxLatencies)
+	}
+}
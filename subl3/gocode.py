@@ -135,6 +135,12 @@ class Gocode(sublime_plugin.EventListener):
 		result = []
 		for line in filter(bool, out.split("\n")):
 			arg = line.split(",,")
+			if arg[0] == "error":
+				sublime.status_message("gocode: {0} error: {1}".format(arg[1], arg[2]))
+				continue
+			if arg[0] == "partial":
+				sublime.status_message("gocode: timed out, completions may be incomplete")
+				continue
 			hint, subj = hint_and_subj(arg[0], arg[1], arg[2])
 			result.append([hint, subj])
 
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+)
+
+var (
+	buildIDOnce sync.Once
+	buildIDStr  string
+)
+
+// buildID returns an identifier for the running gocode binary. It
+// is the Go build ID when one can be found, and otherwise falls back
+// to the executable's size and modification time.
+func buildID() string {
+	buildIDOnce.Do(func() {
+		buildIDStr = readBuildID(get_executable_filename())
+	})
+	return buildIDStr
+}
+
+// sameBuild reports whether id and goVersion identify this gocode
+// binary. An empty id, which gocode builds predating it report, never
+// matches.
+func sameBuild(id, goVersion string) bool {
+	return id != "" && id == buildID() && goVersion == runtime.Version()
+}
+
+func readBuildID(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	// ELF binaries keep the build ID in a note section. Other
+	// formats have it near the start of the text segment.
+	if ef, err := elf.NewFile(f); err == nil {
+		if s := ef.Section(".note.go.buildid"); s != nil {
+			if data, err := s.Data(); err == nil && len(data) > 16 {
+				descsz := int(ef.ByteOrder.Uint32(data[4:]))
+				if 16+descsz <= len(data) {
+					return string(data[16 : 16+descsz])
+				}
+			}
+		}
+	} else {
+		const (
+			prefix = "\xff Go build ID: \""
+			suffix = "\"\n \xff"
+		)
+		buf := make([]byte, 32*1024)
+		n, _ := io.ReadFull(f, buf)
+		buf = buf[:n]
+		if i := bytes.Index(buf, []byte(prefix)); i >= 0 {
+			buf = buf[i+len(prefix):]
+			if j := bytes.Index(buf, []byte(suffix)); j >= 0 {
+				return string(buf[:j])
+			}
+		}
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", fi.Size(), fi.ModTime().UnixNano())
+}
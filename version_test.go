@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestReadBuildID(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(filepath.Join(runtime.GOROOT(), "bin", "go"), "tool", "buildid", exe).Output()
+	if err != nil {
+		t.Skipf("go tool buildid: %v", err)
+	}
+	if got, want := readBuildID(exe), strings.TrimSpace(string(out)); got != want {
+		t.Errorf("readBuildID(%s) = %q, want %q", exe, got, want)
+	}
+
+	// Files without a build ID are identified by size and
+	// modification time.
+	dir := t.TempDir()
+	name := filepath.Join(dir, "gocode")
+	if err := ioutil.WriteFile(name, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readBuildID(name), fmt.Sprintf("%d-%d", fi.Size(), fi.ModTime().UnixNano()); got != want {
+		t.Errorf("readBuildID(%s) = %q, want %q", name, got, want)
+	}
+
+	if got := readBuildID(filepath.Join(dir, "missing")); got != "" {
+		t.Errorf("readBuildID of a missing file = %q, want \"\"", got)
+	}
+}
+
+func TestSameBuild(t *testing.T) {
+	id, goVersion := buildID(), runtime.Version()
+	if id == "" {
+		t.Fatal("no build ID")
+	}
+	tests := []struct {
+		id, goVersion string
+		want          bool
+	}{
+		{id, goVersion, true},
+		{"", goVersion, false},
+		{"", "", false},
+		{id + "x", goVersion, false},
+		{id, goVersion + "x", false},
+	}
+	for _, test := range tests {
+		if got := sameBuild(test.id, test.goVersion); got != test.want {
+			t.Errorf("sameBuild(%q, %q) = %v, want %v", test.id, test.goVersion, got, test.want)
+		}
+	}
+}
+
+func TestAutoCompleteStale(t *testing.T) {
+	s := newServer()
+	req := &AutoCompleteRequest{
+		Filename:  "x.go",
+		Data:      []byte("package p\n\nvar _ = "),
+		Cursor:    len("package p\n\nvar _ = "),
+		BuildID:   "other",
+		GoVersion: runtime.Version(),
+	}
+	var res AutoCompleteReply
+	if err := s.AutoComplete(req, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !sameBuild(res.BuildID, res.GoVersion) {
+		t.Errorf("reply identifies build %q, %q", res.BuildID, res.GoVersion)
+	}
+	if res.Candidates != nil || s.requests != 0 {
+		t.Errorf("a request from a different build was served")
+	}
+}